@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errNotConnected = errors.New("You have not connected a calendar. Run `/cronofy connect` to connect one.")
+
+type LinkingProfile struct {
+	ProviderName string `json:"provider_name"`
+	ProfileId    string `json:"profile_id"`
+	ProfileName  string `json:"profile_name"`
+}
+
+type CronofyUser struct {
+	Accounts []*CronofyAccount `json:"accounts"`
+}
+
+// CronofyAccount is a linked Cronofy account. Profiles added to it share its credentials.
+type CronofyAccount struct {
+	AccessTokenResponse
+
+	Profiles []LinkingProfile `json:"profiles"`
+}
+
+// unmarshalCronofyUser also reads the single AccessTokenResponse stored by earlier versions.
+func unmarshalCronofyUser(data []byte) (*CronofyUser, error) {
+	u := &CronofyUser{}
+	err := json.Unmarshal(data, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(u.Accounts) > 0 {
+		return u, nil
+	}
+
+	legacy := &AccessTokenResponse{}
+	err = json.Unmarshal(data, legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy.AccessToken != "" {
+		u.addAccount(legacy)
+	}
+
+	return u, nil
+}
+
+// addAccount replaces the credentials of an already linked account, adding the new profile.
+func (u *CronofyUser) addAccount(res *AccessTokenResponse) *CronofyAccount {
+	account := u.getAccount(res.AccountId)
+	if account == nil {
+		account = &CronofyAccount{}
+		u.Accounts = append(u.Accounts, account)
+	}
+
+	account.AccessTokenResponse = *res
+	if account.getProfile(res.LinkingProfile.ProfileId) == nil {
+		account.Profiles = append(account.Profiles, res.LinkingProfile)
+	}
+
+	return account
+}
+
+func (u *CronofyUser) getAccount(accountID string) *CronofyAccount {
+	for _, account := range u.Accounts {
+		if account.AccountId == accountID {
+			return account
+		}
+	}
+
+	return nil
+}
+
+func (u *CronofyUser) removeAccount(accountID string) {
+	accounts := []*CronofyAccount{}
+	for _, account := range u.Accounts {
+		if account.AccountId != accountID {
+			accounts = append(accounts, account)
+		}
+	}
+
+	u.Accounts = accounts
+}
+
+// findProfile looks up a profile by its 1-based position in the list, or by name.
+func (u *CronofyUser) findProfile(s string) (*CronofyAccount, *LinkingProfile) {
+	i := 0
+	for _, account := range u.Accounts {
+		for j := range account.Profiles {
+			i++
+			profile := &account.Profiles[j]
+			if s == fmt.Sprintf("%d", i) || s == profile.ProfileName {
+				return account, profile
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (a *CronofyAccount) getProfile(profileID string) *LinkingProfile {
+	for i := range a.Profiles {
+		if a.Profiles[i].ProfileId == profileID {
+			return &a.Profiles[i]
+		}
+	}
+
+	return nil
+}
+
+func (a *CronofyAccount) removeProfile(profileID string) {
+	profiles := []LinkingProfile{}
+	for _, profile := range a.Profiles {
+		if profile.ProfileId != profileID {
+			profiles = append(profiles, profile)
+		}
+	}
+
+	a.Profiles = profiles
+}
+
+func (a *CronofyAccount) describeProfiles() string {
+	names := []string{}
+	for _, profile := range a.Profiles {
+		names = append(names, profile.String())
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func (profile LinkingProfile) String() string {
+	return fmt.Sprintf(`%s "%s"`, prettyProviderName(profile.ProviderName), profile.ProfileName)
+}
+
+func prettyProviderName(provider string) string {
+	switch provider {
+	case "google":
+		return "Google"
+	case "live_connect":
+		return "Outlook"
+	}
+
+	return provider
+}
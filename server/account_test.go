@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalCronofyUser(t *testing.T) {
+	t.Run("legacy single account", func(t *testing.T) {
+		data := []byte(`{"access_token": "token", "account_id": "acc_1", "linking_profile": {"provider_name": "google", "profile_id": "pro_1", "profile_name": "someone@example.com"}}`)
+
+		u, err := unmarshalCronofyUser(data)
+		require.Nil(t, err)
+		require.Len(t, u.Accounts, 1)
+		assert.Equal(t, "token", u.Accounts[0].AccessToken)
+		assert.Equal(t, []LinkingProfile{{ProviderName: "google", ProfileId: "pro_1", ProfileName: "someone@example.com"}}, u.Accounts[0].Profiles)
+	})
+
+	t.Run("several accounts", func(t *testing.T) {
+		data := []byte(`{"accounts": [{"access_token": "token1", "account_id": "acc_1"}, {"access_token": "token2", "account_id": "acc_2"}]}`)
+
+		u, err := unmarshalCronofyUser(data)
+		require.Nil(t, err)
+		require.Len(t, u.Accounts, 2)
+		assert.Equal(t, "token2", u.Accounts[1].AccessToken)
+	})
+}
+
+func TestAddAccount(t *testing.T) {
+	u := &CronofyUser{}
+
+	google := &AccessTokenResponse{AccessToken: "token1", AccountId: "acc_1", LinkingProfile: LinkingProfile{ProfileId: "pro_1"}}
+	u.addAccount(google)
+
+	// A profile added to the same Cronofy account replaces its credentials.
+	outlook := &AccessTokenResponse{AccessToken: "token2", AccountId: "acc_1", LinkingProfile: LinkingProfile{ProfileId: "pro_2"}}
+	u.addAccount(outlook)
+
+	require.Len(t, u.Accounts, 1)
+	assert.Equal(t, "token2", u.Accounts[0].AccessToken)
+	assert.Len(t, u.Accounts[0].Profiles, 2)
+
+	other := &AccessTokenResponse{AccessToken: "token3", AccountId: "acc_2", LinkingProfile: LinkingProfile{ProfileId: "pro_3"}}
+	u.addAccount(other)
+	require.Len(t, u.Accounts, 2)
+
+	account, profile := u.findProfile("3")
+	require.NotNil(t, profile)
+	assert.Equal(t, "acc_2", account.AccountId)
+
+	u.removeAccount("acc_1")
+	require.Len(t, u.Accounts, 1)
+	assert.Equal(t, "acc_2", u.Accounts[0].AccountId)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+)
+
+// agendaSendWindow is how late an agenda is still sent, such as after the job was down.
+const agendaSendWindow = time.Hour
+
+func isWorkingDay(day time.Time) bool {
+	return day.Weekday() != time.Saturday && day.Weekday() != time.Sunday
+}
+
+func isAgendaDue(agendaTime, lastSent string, now time.Time) bool {
+	t, err := time.Parse(agendaTimeFormat, agendaTime)
+	if err != nil || !isWorkingDay(now) || lastSent == now.Format(CRONOFY_DATE_FORMAT) {
+		return false
+	}
+
+	at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	return !now.Before(at) && now.Before(at.Add(agendaSendWindow))
+}
+
+func sendDailyAgenda(h IHandler, userID string, settings *UserSettings) (string, error) {
+	p := h.GetPlugin()
+
+	now := time.Now().In(p.getUserLocation(userID))
+
+	lastSent, err := p.getAgendaSentDate(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if !isAgendaDue(settings.DailyAgendaTime, lastSent, now) {
+		return "Agenda not due.", nil
+	}
+
+	today := startOfDay(now)
+	res, err := getUserEvents(h, userID, today, today.AddDate(0, 0, 1))
+	if err != nil {
+		return "", err
+	}
+
+	// Claim the day first so another node can't send it too.
+	claimed, err := p.compareAndStoreAgendaSentDate(userID, lastSent, today.Format(CRONOFY_DATE_FORMAT))
+	if err != nil {
+		return "", err
+	}
+
+	if !claimed {
+		return "Agenda already sent.", nil
+	}
+
+	events := []*cronofy.Event{}
+	for _, evt := range res.Events {
+		if !evt.Declined() && !isEventRemoved(evt) {
+			events = append(events, evt)
+		}
+	}
+
+	// A day which only looks empty because some calendars couldn't be read isn't skipped.
+	if len(events) == 0 && len(res.Errors) == 0 && settings.AgendaSkipEmptyDays {
+		return "No events today. Skipped agenda.", nil
+	}
+
+	_, err = p.CreateBotDMtoMMUserId(userID, "%s", formatAgenda(events, res.Errors, today, res.Location))
+	if err != nil {
+		return "", err
+	}
+
+	return "Sent agenda.", nil
+}
+
+func formatAgenda(events []*cronofy.Event, errs []string, day time.Time, loc *time.Location) string {
+	text := formatAgendaEvents(events, day, loc)
+	if len(errs) > 0 {
+		text += "\n\nSome of your calendars couldn't be read, so your agenda may be incomplete:\n* " + strings.Join(errs, "\n* ")
+	}
+
+	return text
+}
+
+func formatAgendaEvents(events []*cronofy.Event, day time.Time, loc *time.Location) string {
+	title := fmt.Sprintf("### Your agenda for %s\n", day.Format(DEFAULT_DATE_FORMAT))
+	if len(events) == 0 {
+		return title + "\nYou have no events today."
+	}
+
+	rows := []string{title, prettyPrintEventList(events, findEventConflicts(events, loc), day, day.AddDate(0, 0, 1), loc)}
+
+	needsAction := []string{}
+	for _, evt := range events {
+		if evt.ParticipationStatus == "needs_action" {
+			needsAction = append(needsAction, fmt.Sprintf("* \"%s\", %s", evt.Summary, formatEventTimeRange(evt, loc)))
+		}
+	}
+
+	if len(needsAction) > 0 {
+		rows = append(rows, "\n#### Awaiting your reply\n", strings.Join(needsAction, "\n"), "\n")
+	}
+
+	return strings.Join(rows, "")
+}
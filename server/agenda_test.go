@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsAgendaDue(t *testing.T) {
+	monday := time.Date(2019, 11, 25, 9, 5, 0, 0, time.UTC)
+
+	assert.True(t, isAgendaDue("09:00", "2019-11-22", monday))
+	assert.False(t, isAgendaDue("09:00", "2019-11-25", monday), "already sent today")
+	assert.False(t, isAgendaDue("09:30", "", monday), "before the agenda time")
+	assert.False(t, isAgendaDue("07:00", "", monday), "too long after the agenda time")
+	assert.False(t, isAgendaDue("09:00", "", monday.AddDate(0, 0, 5)), "saturday")
+	assert.False(t, isAgendaDue("", "", monday))
+}
+
+func TestFormatAgenda(t *testing.T) {
+	day := time.Date(2019, 11, 25, 0, 0, 0, 0, time.UTC)
+
+	standup := &cronofy.Event{Summary: "Standup", Start: "2019-11-25T09:30:00Z", End: "2019-11-25T10:00:00Z", ParticipationStatus: "accepted"}
+	review := &cronofy.Event{Summary: "Review", Start: "2019-11-25T09:45:00Z", End: "2019-11-25T10:30:00Z", ParticipationStatus: "needs_action"}
+	focus := &cronofy.Event{Summary: "Focus", Start: "2019-11-25T09:00:00Z", End: "2019-11-25T12:00:00Z", Transparency: "transparent"}
+
+	overlaps := findOverlappingEvents([]*cronofy.Event{review, focus, standup}, time.UTC)
+	assert.Equal(t, []EventOverlap{{standup, review}}, overlaps)
+
+	text := formatAgenda([]*cronofy.Event{standup, review, focus}, nil, day, time.UTC)
+	assert.Contains(t, text, "### Your agenda for Monday November 25")
+	assert.Contains(t, text, "#### Awaiting your reply\n* \"Review\"")
+	assert.Contains(t, text, "**Conflicts with** \"Review\"")
+	assert.Contains(t, text, "**Conflicts with** \"Standup\"")
+	assert.NotContains(t, text, "**Conflicts with** \"Focus\"")
+
+	assert.NotContains(t, text, "couldn't be read")
+	assert.Contains(t, formatAgenda(nil, nil, day, time.UTC), "You have no events today.")
+
+	text = formatAgenda([]*cronofy.Event{standup}, []string{"Error fetching events for someone@example.com: timeout"}, day, time.UTC)
+	assert.Contains(t, text, "Standup")
+	assert.Contains(t, text, "may be incomplete:\n* Error fetching events for someone@example.com: timeout")
+}
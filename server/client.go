@@ -3,8 +3,13 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jeffreylo/cronofy"
@@ -13,13 +18,37 @@ import (
 
 type ICronofyClient interface {
 	CronofyRequest(userID string, reqURL string, payload interface{}) (int, []byte, error)
+	CronofyRequestWithMethod(userID string, method string, reqURL string, payload interface{}) (int, []byte, error)
 	GetCalendars() ([]*cronofy.Calendar, error)
-	GetEvents(options *cronofy.EventsRequest) (*cronofy.EventsResponse, error)
+	GetEvents(options *cronofy.EventsRequest) (*EventsResponse, error)
 }
 
+type Conferencing struct {
+	ProviderDescription string `json:"provider_description"`
+	JoinURL             string `json:"join_url"`
+}
+
+// EventsResponse adds the conferencing details, by event UID, which the cronofy library doesn't read.
+type EventsResponse struct {
+	cronofy.EventsResponse
+
+	Conferencing map[string]*Conferencing
+}
+
+type TokenRefresher func(rejectedToken string) (string, error)
+
+const cronofyAPIURL = "https://api.cronofy.com/v1"
+
+// maxEventPages caps the pages read for one request, at 100 events per page.
+const maxEventPages = 50
+
 type CronofyClient struct {
 	AccessToken string
 	client      *cronofy.Client
+	baseURL     string
+
+	// refresh is used to retry once on a 401.
+	refresh TokenRefresher
 }
 
 func NewCronofyClient(accessToken string) *CronofyClient {
@@ -30,18 +59,124 @@ func NewCronofyClient(accessToken string) *CronofyClient {
 	return &CronofyClient{
 		AccessToken: accessToken,
 		client:      c,
+		baseURL:     cronofyAPIURL,
 	}
 }
 
+func NewRefreshingCronofyClient(accessToken string, refresh TokenRefresher) *CronofyClient {
+	c := NewCronofyClient(accessToken)
+	c.refresh = refresh
+	return c
+}
+
 func (c *CronofyClient) GetCalendars() ([]*cronofy.Calendar, error) {
-	return c.client.GetCalendars()
+	calendars, err := c.client.GetCalendars()
+	if isUnauthorizedError(err) && c.refreshAccessToken() {
+		return c.client.GetCalendars()
+	}
+	return calendars, err
+}
+
+// GetEvents follows next_page links, failing rather than returning a partial result past maxEventPages.
+func (c *CronofyClient) GetEvents(options *cronofy.EventsRequest) (*EventsResponse, error) {
+	reqURL := c.baseURL + "/events?" + encodeEventsRequest(options).Encode()
+
+	res := &EventsResponse{Conferencing: map[string]*Conferencing{}}
+	for page := 0; reqURL != ""; page++ {
+		if page == maxEventPages {
+			return nil, fmt.Errorf("Cronofy returned more than %d pages of events", maxEventPages)
+		}
+
+		status, data, err := c.CronofyRequestWithMethod("", http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, err
+		} else if status >= 300 {
+			return nil, fmt.Errorf("Cronofy returned status %d %s", status, string(data))
+		}
+
+		pageRes := &cronofy.EventsResponse{}
+		err = json.Unmarshal(data, pageRes)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read events from Cronofy")
+		}
+
+		conferencing := struct {
+			Events []struct {
+				EventUID     string        `json:"event_uid"`
+				Conferencing *Conferencing `json:"conferencing"`
+			} `json:"events"`
+		}{}
+		err = json.Unmarshal(data, &conferencing)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read events from Cronofy")
+		}
+
+		res.Events = append(res.Events, pageRes.Events...)
+		res.Pages = pageRes.Pages
+		for _, evt := range conferencing.Events {
+			if evt.Conferencing != nil && evt.Conferencing.JoinURL != "" {
+				res.Conferencing[evt.EventUID] = evt.Conferencing
+			}
+		}
+
+		reqURL = ""
+		if pageRes.Pages != nil && pageRes.Pages.Next != "" {
+			// The access token is sent with each page, so only Cronofy's own links are followed.
+			if !strings.HasPrefix(pageRes.Pages.Next, c.baseURL+"/") {
+				return nil, fmt.Errorf("Cronofy returned an unexpected next page %s", pageRes.Pages.Next)
+			}
+			reqURL = pageRes.Pages.Next
+		}
+	}
+
+	return res, nil
 }
 
-func (c *CronofyClient) GetEvents(options *cronofy.EventsRequest) (*cronofy.EventsResponse, error) {
-	return c.client.GetEvents(options)
+func encodeEventsRequest(options *cronofy.EventsRequest) url.Values {
+	query := url.Values{}
+	query.Set("tzid", options.TZID)
+	for _, id := range options.CalendarIDs {
+		query.Add("calendar_ids[]", id)
+	}
+	if options.From != nil {
+		query.Set("from", *options.From)
+	}
+	if options.To != nil {
+		query.Set("to", *options.To)
+	}
+	if options.LastModified != nil {
+		query.Set("last_modified", options.LastModified.UTC().Format(CRONOFY_DATETIME_FORMAT))
+	}
+
+	flags := map[string]*bool{
+		"include_deleted": options.IncludeDeleted,
+		"include_geo":     options.IncludeGeo,
+		"include_moved":   options.IncludeMoved,
+		"localized_times": options.LocalizedTimes,
+		"only_managed":    options.OnlyManaged,
+	}
+	for name, value := range flags {
+		if value != nil {
+			query.Set(name, strconv.FormatBool(*value))
+		}
+	}
+
+	return query
 }
 
 func (c *CronofyClient) CronofyRequest(userID string, reqURL string, payload interface{}) (int, []byte, error) {
+	return c.CronofyRequestWithMethod(userID, http.MethodPost, reqURL, payload)
+}
+
+func (c *CronofyClient) CronofyRequestWithMethod(userID string, method string, reqURL string, payload interface{}) (int, []byte, error) {
+	status, data, err := c.doCronofyRequest(method, reqURL, payload)
+	if err == nil && status == http.StatusUnauthorized && c.refreshAccessToken() {
+		return c.doCronofyRequest(method, reqURL, payload)
+	}
+	return status, data, err
+}
+
+func (c *CronofyClient) doCronofyRequest(method string, reqURL string, payload interface{}) (int, []byte, error) {
 	accessToken := c.AccessToken
 
 	timeout := time.Duration(5 * time.Second)
@@ -49,17 +184,23 @@ func (c *CronofyClient) CronofyRequest(userID string, reqURL string, payload int
 		Timeout: timeout,
 	}
 
-	jsonPayload, err := json.Marshal(&payload)
-	if err != nil {
-		return 0, nil, errors.Wrap(err, "CronofyRequest 1")
+	var reqBody io.Reader
+	if payload != nil {
+		jsonPayload, err := json.Marshal(&payload)
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "CronofyRequest 1")
+		}
+		reqBody = bytes.NewBuffer(jsonPayload)
 	}
 
-	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(jsonPayload))
+	req, err := http.NewRequest(method, reqURL, reqBody)
 	if err != nil {
 		return 0, nil, errors.Wrap(err, "CronofyRequest 2")
 	}
 
-	req.Header.Add("Content-Type", "application/json; charset=utf-8")
+	if payload != nil {
+		req.Header.Add("Content-Type", "application/json; charset=utf-8")
+	}
 	req.Header.Add("Authorization", "Bearer "+accessToken)
 
 	resp, err := client.Do(req)
@@ -76,3 +217,28 @@ func (c *CronofyClient) CronofyRequest(userID string, reqURL string, payload int
 
 	return resp.StatusCode, data, nil
 }
+
+func (c *CronofyClient) refreshAccessToken() bool {
+	if c.refresh == nil {
+		return false
+	}
+
+	accessToken, err := c.refresh(c.AccessToken)
+	if err != nil || accessToken == c.AccessToken {
+		return false
+	}
+
+	c.AccessToken = accessToken
+	c.client = cronofy.NewClient(&cronofy.Config{
+		AccessToken: accessToken,
+	})
+	// Only retry once per client.
+	c.refresh = nil
+
+	return true
+}
+
+func isUnauthorizedError(err error) bool {
+	statusErr, ok := errors.Cause(err).(interface{ HTTPStatusCode() int })
+	return ok && statusErr.HTTPStatusCode() == http.StatusUnauthorized
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeCronofyServer serves the given number of pages of events, with one event on each page.
+// With pages set to zero, it serves pages forever.
+func newFakeCronofyServer(t *testing.T, pages int) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		page := 1
+		if strings.HasPrefix(r.URL.Path, "/events/pages/") {
+			_, err := fmt.Sscanf(r.URL.Path, "/events/pages/%d", &page)
+			require.Nil(t, err)
+		} else {
+			assert.Equal(t, "/events", r.URL.Path)
+			assert.Equal(t, "Europe/Berlin", r.URL.Query().Get("tzid"))
+			assert.Equal(t, []string{"cal_1", "cal_2"}, r.URL.Query()["calendar_ids[]"])
+			assert.Equal(t, "true", r.URL.Query().Get("include_deleted"))
+		}
+
+		res := map[string]interface{}{
+			"pages": map[string]interface{}{"current": page, "total": pages},
+			"events": []map[string]interface{}{{
+				"calendar_id": "cal_1",
+				"event_uid":   fmt.Sprintf("evt_%d", page),
+				"start":       "2019-11-25T19:00:00Z",
+				"end":         "2019-11-25T19:45:00Z",
+			}},
+		}
+		if pages == 0 || page < pages {
+			res["pages"].(map[string]interface{})["next_page"] = fmt.Sprintf("%s/events/pages/%d", server.URL, page+1)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+
+	return server
+}
+
+func TestGetEventsPagination(t *testing.T) {
+	includeDeleted := true
+	req := &cronofy.EventsRequest{
+		TZID:           "Europe/Berlin",
+		CalendarIDs:    []string{"cal_1", "cal_2"},
+		IncludeDeleted: &includeDeleted,
+	}
+
+	t.Run("reads every page", func(t *testing.T) {
+		server := newFakeCronofyServer(t, 3)
+		defer server.Close()
+
+		client := NewCronofyClient("token")
+		client.baseURL = server.URL
+
+		res, err := client.GetEvents(req)
+		require.Nil(t, err)
+		require.Len(t, res.Events, 3)
+		assert.Equal(t, "evt_1", res.Events[0].EventUID)
+		assert.Equal(t, "evt_3", res.Events[2].EventUID)
+	})
+
+	t.Run("stops at the page cap", func(t *testing.T) {
+		server := newFakeCronofyServer(t, 0)
+		defer server.Close()
+
+		client := NewCronofyClient("token")
+		client.baseURL = server.URL
+
+		_, err := client.GetEvents(req)
+		assert.NotNil(t, err)
+	})
+}
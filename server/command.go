@@ -2,10 +2,15 @@ package main
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/jeffreylo/cronofy"
 	"github.com/mattermost/mattermost-server/model"
 	"github.com/mattermost/mattermost-server/plugin"
+	"github.com/pkg/errors"
 )
 
 type CommandHandlerFunc func(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse
@@ -17,10 +22,30 @@ type CommandHandler struct {
 
 var commandHandler = CommandHandler{
 	handlers: map[string]CommandHandlerFunc{
-		"view":         executeView,
-		"subscribe":    executeSubscribe,
-		"connect":      executeConnect,
-		"availability": executeAvailability,
+		"view":                      executeView,
+		"next":                      executeNext,
+		"create":                    executeCreate,
+		"schedule":                  executeSchedule,
+		"subscribe":                 executeSubscribe,
+		"subscribe/list":            executeSubscribeList,
+		"subscribe/close":           executeSubscribeClose,
+		"connect":                   executeConnect,
+		"disconnect":                executeDisconnect,
+		"accounts":                  executeAccounts,
+		"availability":              executeAvailability,
+		"availability/set":          executeAvailabilitySet,
+		"availability/reset":        executeAvailabilityReset,
+		"settings":                  executeSettings,
+		"settings/show":             executeSettingsShow,
+		"settings/statussync":       executeSettingsStatusSync,
+		"settings/customstatus":     executeSettingsCustomStatus,
+		"settings/reminder":         executeSettingsReminder,
+		"settings/agenda":           executeSettingsAgenda,
+		"settings/agenda/skipempty": executeSettingsAgendaSkipEmpty,
+		"settings/timezone":         executeSettingsTimezone,
+		"settings/calendars":        executeSettingsCalendars,
+		"settings/mute":             executeSettingsMute,
+		"settings/unmute":           executeSettingsUnmute,
 	},
 	defaultHandler: executeDefaultCommand,
 }
@@ -52,7 +77,7 @@ func getCommand() *model.Command {
 		DisplayName:      "Cronofy",
 		Description:      "Integration with Cronofy.",
 		AutoComplete:     true,
-		AutoCompleteDesc: "Available commands: connect, view, subscribe, availability",
+		AutoCompleteDesc: "Available commands: connect, disconnect, accounts, view, next, create, schedule, subscribe, availability, settings",
 		AutoCompleteHint: "[command]",
 	}
 }
@@ -60,61 +85,192 @@ func getCommand() *model.Command {
 func executeView(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
 	p := h.GetPlugin()
 
-	info, err := p.getCronofyUser(header.UserId)
+	now := time.Now().In(p.getUserLocation(header.UserId))
+	query, err := parseViewQuery(args, now)
 	if err != nil {
 		return p.responsef(header, err.Error())
 	}
 
-	accessToken := info.AccessToken
-	client := NewCronofyClient(accessToken)
+	res, err := getUserEvents(h, header.UserId, query.From, query.To)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	for _, e := range res.Errors {
+		p.responsef(header, e)
+	}
 
-	calendars, err := client.GetCalendars()
+	err = p.storeEvents(header.UserId, res.Events)
 	if err != nil {
-		p.responsef(header, fmt.Sprintf("Error: %s", err.Error()))
+		return p.responsef(header, err.Error())
+	}
+
+	if query.Calendar != "" && !res.filterCalendar(query.Calendar) {
+		return p.responsef(header, fmt.Sprintf("You have no calendar named %s", query.Calendar))
 	}
 
-	if len(calendars) == 0 {
+	if len(res.Calendars) == 0 {
 		return p.responsef(header, "No calendars matched the query")
 	}
 
-	calenderIDs := []string{}
-	for _, c := range calendars {
-		calenderIDs = append(calenderIDs, c.CalendarID)
+	events := &cronofy.EventsResponse{Events: res.Events}
+	text := prettyPrintEventsResponse(res.Calendars, events, query.From, query.To, res.Location)
+	if len(res.Events) == 0 {
+		text = formatViewTitle(query.From, query.To) + "You have no events."
 	}
 
-	events, err := getCalendarInfo(info.AccessToken, calenderIDs)
+	for _, message := range splitMessage(text, model.POST_MESSAGE_MAX_RUNES_V2) {
+		p.postCommandResponse(header, message)
+	}
+
+	return &model.CommandResponse{}
+}
+
+var executeDefaultCommand = executeView
+
+func executeNext(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	now := time.Now().In(p.getUserLocation(header.UserId))
+	res, err := getUserEvents(h, header.UserId, now.Add(-nextEventGracePeriod), now.Add(nextEventLookahead))
 	if err != nil {
 		return p.responsef(header, err.Error())
 	}
 
-	err = p.storeEvents(events.Events)
+	for _, e := range res.Errors {
+		p.responsef(header, e)
+	}
+
+	evt := findNextEvent(res.Events, now)
+	if evt == nil {
+		return p.responsef(header, "You have no events in the next 7 days.")
+	}
+
+	p.postCommandResponse(header, formatNextEvent(evt, res.Conferencing[evt.EventUID], now))
+	return &model.CommandResponse{}
+}
+
+func executeCreate(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	_, err := p.getCronofyUser(header.UserId)
 	if err != nil {
 		return p.responsef(header, err.Error())
 	}
 
-	return p.responsef(header, prettyPrintEventsResponse(calendars, events))
+	err = openCreateEventDialog(h, header, strings.Join(args, " "))
+	if err != nil {
+		return p.responsef(header, fmt.Sprintf("Failed to open the event dialog: %s", err.Error()))
+	}
+
+	return &model.CommandResponse{}
 }
 
-var executeDefaultCommand = executeView
+func executeSchedule(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	loc := p.getUserLocation(header.UserId)
+	query, err := parseScheduleQuery(args, time.Now().In(loc))
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	participants, err := getScheduleParticipants(p, header.UserId, query.Usernames)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	periods := buildSchedulePeriods(query.From, query.To, query.Duration)
+	slots := []AvailabilityPeriod{}
+	if len(periods) > 0 {
+		slots, err = getGroupAvailability(h, header.UserId, participants.Members, periods, query.Duration)
+		if err != nil {
+			return p.responsef(header, fmt.Sprintf("Failed to find a time: %s", err.Error()))
+		}
+	}
+
+	post := &model.Post{
+		UserId:    header.UserId,
+		ChannelId: header.ChannelId,
+		Message:   formatScheduleMessage(query, participants, len(slots) > 0),
+	}
+	if len(slots) > 0 {
+		model.ParseSlackAttachment(post, []*model.SlackAttachment{getScheduleAttachment(participants, slots, loc)})
+	}
+
+	_ = p.API.SendEphemeralPost(header.UserId, post)
+	return &model.CommandResponse{}
+}
 
 func executeSubscribe(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
 	p := h.GetPlugin()
 
-	s, err := createNotificationChannel(h, header.UserId)
+	err := syncUserNotificationChannels(h, header.UserId)
 	if err != nil {
-		p.responsef(header, fmt.Sprintf("Error: %s", err.Error()))
+		return p.responsef(header, fmt.Sprintf("Error: %s", err.Error()))
 	}
 
-	data := []byte(s)
-	p.API.KVSet("cronofy_notification_channel", data)
-
 	return p.responsef(header, "Successfully created a subscription to update your Mattermost status based on your calendar availability.")
 }
 
+func executeSubscribeList(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	clients, err := h.MakeUserCronofyClients(header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	rows := []string{"#### Calendar subscriptions\n"}
+	for _, ac := range clients {
+		channels, err := getNotificationChannels(ac.Client, header.UserId)
+		if err != nil {
+			rows = append(rows, fmt.Sprintf("* %s: Error: %s", ac.Account.describeProfiles(), err.Error()))
+			continue
+		}
+
+		if len(channels) == 0 {
+			rows = append(rows, fmt.Sprintf("* %s: No subscriptions", ac.Account.describeProfiles()))
+			continue
+		}
+
+		callbackURL := getNotificationCallbackURL(p, header.UserId, ac.Account.AccountId)
+		for _, channel := range channels {
+			state := "active"
+			if channel.CallbackUrl != callbackURL {
+				state = "stale, run `/cronofy subscribe` to repair"
+			}
+			rows = append(rows, fmt.Sprintf("* %s: `%s` (%s)", ac.Account.describeProfiles(), channel.ChannelId, state))
+		}
+	}
+
+	return p.responsef(header, strings.Join(rows, "\n"))
+}
+
+func executeSubscribeClose(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	channelID := ""
+	if len(args) > 0 {
+		channelID = args[0]
+	}
+
+	closed, err := closeUserNotificationChannel(h, header.UserId, channelID)
+	if err != nil {
+		return p.responsef(header, fmt.Sprintf("Error: %s", err.Error()))
+	}
+
+	if closed == 0 {
+		return p.responsef(header, "No matching subscriptions found. Run `/cronofy subscribe list` to list them.")
+	}
+
+	return p.responsef(header, fmt.Sprintf("Closed %d subscription(s). You will no longer receive notifications for them.", closed))
+}
+
 func executeConnect(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
 	p := h.GetPlugin()
 
-	scope := "read_events change_participation_status"
+	scope := "read_events change_participation_status create_event delete_event"
 	clientID := p.getConfiguration().ClientID
 	redirectURL := p.getSiteURL() + "/plugins/cronofy/oauth/complete"
 
@@ -122,12 +278,167 @@ func executeConnect(h IHandler, c *plugin.Context, header *model.CommandArgs, ar
 	if err != nil {
 		return p.responsef(header, fmt.Sprintf("Failed to create hash: %s", err.Error()))
 	}
-	p.storeOAuthUserState(header.UserId, hash)
+
+	err = p.storeOAuthUserState(header.UserId, hash)
+	if err != nil {
+		return p.responsef(header, fmt.Sprintf("Failed to store OAuth state: %s", err.Error()))
+	}
 
 	state := header.UserId + "||" + string(hash)
 
-	callback := fmt.Sprintf(`https://app.cronofy.com/oauth/authorize?response_type=code&client_id=%s&redirect_uri=%s&scope=%s&state=%s`, clientID, redirectURL, scope, state)
-	return p.responsef(header, fmt.Sprintf("#### [Click me to connect!](%s)", callback))
+	params := url.Values{}
+	params.Add("response_type", "code")
+	params.Add("client_id", clientID)
+	params.Add("redirect_uri", redirectURL)
+	params.Add("scope", scope)
+	params.Add("state", state)
+
+	callback := "https://app.cronofy.com/oauth/authorize?" + params.Encode()
+	return p.responsef(header, fmt.Sprintf("#### [Click me to connect!](%s)\nThis link expires in %d minutes.", callback, int(OAuthStateExpiry/time.Minute)))
+}
+
+func executeAccounts(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	cronofyUser, err := p.getCronofyUser(header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	rows := []string{"#### Linked calendar accounts\n"}
+	i := 0
+	for _, account := range cronofyUser.Accounts {
+		for _, profile := range account.Profiles {
+			i++
+			rows = append(rows, fmt.Sprintf("%d. %s", i, profile.String()))
+		}
+	}
+	rows = append(rows, "\nRun `/cronofy disconnect <number or email>` to remove one of them, or `/cronofy connect` to link another.")
+
+	return p.responsef(header, strings.Join(rows, "\n"))
+}
+
+func executeDisconnect(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	cronofyUser, err := p.getCronofyUser(header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	if len(args) > 0 {
+		return disconnectProfile(h, header, cronofyUser, args[0])
+	}
+
+	warnings := []string{}
+	_, err = restoreUserStatus(h, header.UserId)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("Failed to restore your status: %s", err.Error()))
+	}
+
+	err = clearUserCustomStatus(h, header.UserId)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("Failed to clear your custom status: %s", err.Error()))
+	}
+
+	for _, account := range cronofyUser.Accounts {
+		warnings = append(warnings, disconnectAccount(h, header.UserId, account)...)
+	}
+
+	err = p.deleteUserData(header.UserId)
+	if err != nil {
+		return p.responsef(header, fmt.Sprintf("Failed to delete your calendar data: %s", err.Error()))
+	}
+
+	text := "Your calendars have been disconnected from your Mattermost account."
+	if len(warnings) > 0 {
+		text += "\n" + strings.Join(warnings, "\n")
+	}
+	p.CreateBotDMtoMMUserId(header.UserId, text)
+
+	return &model.CommandResponse{}
+}
+
+// disconnectProfile revokes the whole account once its last profile is removed.
+func disconnectProfile(h IHandler, header *model.CommandArgs, cronofyUser *CronofyUser, s string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	account, profile := cronofyUser.findProfile(s)
+	if profile == nil {
+		return p.responsef(header, fmt.Sprintf("No linked calendar account matches \"%s\". Run `/cronofy accounts` to list them.", s))
+	}
+
+	name := profile.String()
+	warnings := []string{}
+	if len(account.Profiles) > 1 {
+		client := h.MakeAccountCronofyClient(header.UserId, account)
+		err := revokeProfile(client, header.UserId, profile.ProfileId)
+		if err != nil {
+			return p.responsef(header, fmt.Sprintf("Failed to disconnect %s: %s", name, err.Error()))
+		}
+		account.removeProfile(profile.ProfileId)
+	} else {
+		warnings = disconnectAccount(h, header.UserId, account)
+		cronofyUser.removeAccount(account.AccountId)
+
+		channels, err := p.getUserNotificationChannels(header.UserId)
+		if err == nil {
+			delete(channels, account.AccountId)
+			err = p.storeUserNotificationChannels(header.UserId, channels)
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("Failed to update your subscriptions: %s", err.Error()))
+		}
+	}
+
+	var err error
+	if len(cronofyUser.Accounts) == 0 {
+		_, _ = restoreUserStatus(h, header.UserId)
+		_ = clearUserCustomStatus(h, header.UserId)
+		err = p.deleteUserData(header.UserId)
+	} else {
+		err = p.storeCronofyUser(header.UserId, cronofyUser)
+	}
+	if err != nil {
+		return p.responsef(header, fmt.Sprintf("Failed to update your calendar data: %s", err.Error()))
+	}
+
+	text := fmt.Sprintf("Your %s account has been disconnected from your Mattermost account.", name)
+	if len(warnings) > 0 {
+		text += "\n" + strings.Join(warnings, "\n")
+	}
+	p.CreateBotDMtoMMUserId(header.UserId, text)
+
+	return &model.CommandResponse{}
+}
+
+func disconnectAccount(h IHandler, userID string, account *CronofyAccount) []string {
+	p := h.GetPlugin()
+	name := account.describeProfiles()
+	warnings := []string{}
+
+	// Channels are closed before revoking, while the token can still authenticate the requests.
+	client := h.MakeAccountCronofyClient(userID, account)
+	channels, err := getNotificationChannels(client, userID)
+	for _, channel := range channels {
+		if closeErr := closeNotificationChannel(client, userID, channel.ChannelId); closeErr != nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("Failed to close calendar notifications for %s: %s", name, err.Error()))
+	}
+
+	token := account.RefreshToken
+	if token == "" {
+		token = account.AccessToken
+	}
+	err = revokeToken(p, token)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("Failed to revoke access to %s with Cronofy: %s", name, err.Error()))
+	}
+
+	return warnings
 }
 
 func executeAvailability(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
@@ -140,3 +451,272 @@ func executeAvailability(h IHandler, c *plugin.Context, header *model.CommandArg
 
 	return p.responsef(header, fmt.Sprintf(res))
 }
+
+var availabilityOptionNames = []string{"lookahead", "duration", "buffer-before", "buffer-after", "freebusy"}
+
+func executeAvailabilitySet(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	_, err := p.getCronofyUser(header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	settings, err := p.getUserSettings(header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	if len(args) == 0 {
+		opts, err := p.getUserAvailabilityOptions(settings)
+		if err != nil {
+			return p.responsef(header, err.Error())
+		}
+		return p.responsef(header, formatAvailabilityOptions(opts))
+	}
+
+	if len(args) != 2 {
+		return p.responsef(header, fmt.Sprintf("Please run `/cronofy availability set <option> <value>`. The options are: %s", strings.Join(availabilityOptionNames, ", ")))
+	}
+
+	name, value := args[0], args[1]
+	overrides := &settings.Availability
+	if name == "freebusy" {
+		switch value {
+		case "on", "true":
+			overrides.UseFreeBusy = model.NewBool(true)
+		case "off", "false":
+			overrides.UseFreeBusy = model.NewBool(false)
+		default:
+			return p.responsef(header, "Please use `on` or `off` for the freebusy option.")
+		}
+	} else {
+		minutes, err := strconv.Atoi(strings.TrimSuffix(value, "m"))
+		if err != nil {
+			return p.responsef(header, fmt.Sprintf("%s is not a number of minutes.", value))
+		}
+
+		switch name {
+		case "lookahead":
+			overrides.Lookahead = &minutes
+		case "duration":
+			overrides.RequiredDuration = &minutes
+		case "buffer-before":
+			overrides.BufferBefore = &minutes
+		case "buffer-after":
+			overrides.BufferAfter = &minutes
+		default:
+			return p.responsef(header, fmt.Sprintf("Unknown option %s. The options are: %s", name, strings.Join(availabilityOptionNames, ", ")))
+		}
+	}
+
+	defaults, err := p.getConfiguration().getAvailabilityOptions()
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	opts := overrides.apply(defaults)
+	err = opts.validate()
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	err = p.storeUserSettings(header.UserId, settings)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	return p.responsef(header, "Updated your availability settings.\n"+formatAvailabilityOptions(opts))
+}
+
+func executeAvailabilityReset(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	settings, err := p.getUserSettings(header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	settings.Availability = AvailabilityOverrides{}
+	err = p.storeUserSettings(header.UserId, settings)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	return p.responsef(header, "Your availability settings have been reset to the defaults.")
+}
+
+func formatAvailabilityOptions(opts *AvailabilityOptions) string {
+	check := fmt.Sprintf("You are available when you have %d free minutes in the next %d minutes.", opts.RequiredDuration, opts.Lookahead)
+	if opts.UseFreeBusy {
+		check = "You are available when your calendar is free right now."
+	}
+
+	return fmt.Sprintf("%s You are treated as busy %d minutes before and %d minutes after each event.", check, opts.BufferBefore, opts.BufferAfter)
+}
+
+func executeSettings(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	if len(args) > 0 {
+		return p.responsef(header, "Unknown settings command %s. Available commands: show, statussync, customstatus, reminder, agenda, timezone, calendars, mute, unmute", args[0])
+	}
+
+	_, err := p.getCronofyUser(header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	err = openSettingsDialog(h, header)
+	if err != nil {
+		return p.responsef(header, fmt.Sprintf("Failed to open the settings dialog: %s", err.Error()))
+	}
+
+	return &model.CommandResponse{}
+}
+
+func executeSettingsShow(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		return nil
+	})
+}
+
+func executeSettingsStatusSync(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		enable, err := parseOnOff(args)
+		if err != nil {
+			return err
+		}
+		settings.StatusSync = enable
+		return nil
+	})
+}
+
+func executeSettingsCustomStatus(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		enable, err := parseOnOff(args)
+		if err != nil {
+			return err
+		}
+		if enable && !p.supportsCustomStatus() {
+			return errCustomStatusNotSupported
+		}
+		settings.CustomStatus = enable
+		return nil
+	})
+}
+
+func executeSettingsReminder(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		if len(args) != 1 {
+			return errors.New("Please run `/cronofy settings reminder <minutes|off>`")
+		}
+		return settings.setReminder(args[0])
+	})
+}
+
+func executeSettingsAgenda(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		if len(args) != 1 {
+			return errors.New("Please run `/cronofy settings agenda <HH:MM|off>` or `/cronofy settings agenda skipempty <on|off>`")
+		}
+		return settings.setDailyAgendaTime(args[0])
+	})
+}
+
+func executeSettingsAgendaSkipEmpty(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		skip, err := parseOnOff(args)
+		if err != nil {
+			return err
+		}
+		settings.AgendaSkipEmptyDays = skip
+		return nil
+	})
+}
+
+func executeSettingsTimezone(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		if len(args) != 1 {
+			return errors.New("Please run `/cronofy settings timezone <timezone|auto>`")
+		}
+		return settings.setTimezone(args[0])
+	})
+}
+
+func executeSettingsCalendars(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		if len(args) == 0 {
+			return nil
+		}
+		if len(calendarErrs) > 0 {
+			return fmt.Errorf("Some of your calendars couldn't be read, so the included calendars can't be changed right now:\n* %s", strings.Join(calendarErrs, "\n* "))
+		}
+		return settings.setCalendars(args, calendars)
+	})
+}
+
+func executeSettingsMute(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("Please run `/cronofy settings mute <type>`. The types are: %s", strings.Join(eventChangeTypeNames(), ", "))
+		}
+		return settings.setMuted(args, true)
+	})
+}
+
+func executeSettingsUnmute(h IHandler, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return updateSettings(h, header, func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("Please run `/cronofy settings unmute <type>`. The types are: %s", strings.Join(eventChangeTypeNames(), ", "))
+		}
+		return settings.setMuted(args, false)
+	})
+}
+
+func updateSettings(h IHandler, header *model.CommandArgs, change func(settings *UserSettings, calendars []*cronofy.Calendar, calendarErrs []string) error) *model.CommandResponse {
+	p := h.GetPlugin()
+
+	_, err := p.getCronofyUser(header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	prev, err := p.getUserSettings(header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	calendars, calendarErrs, err := getUserCalendars(h, header.UserId)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	settings := *prev
+	err = change(&settings, calendars, calendarErrs)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	err = saveUserSettings(h, header.UserId, prev, &settings)
+	if err != nil {
+		return p.responsef(header, err.Error())
+	}
+
+	return p.responsef(header, formatUserSettings(&settings, calendars, calendarErrs)+formatJobDisabledWarning(p, &settings))
+}
+
+func parseOnOff(args []string) (bool, error) {
+	if len(args) == 1 {
+		switch args[0] {
+		case "on":
+			return true, nil
+		case "off":
+			return false, nil
+		}
+	}
+
+	return false, errors.New("Please use `on` or `off`.")
+}
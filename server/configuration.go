@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -10,8 +13,91 @@ type configuration struct {
 	ClientID     string
 	ClientSecret string
 
-	InternalSecret        string
+	// WebhookSecret authenticates channels created before webhooks were signed.
+	WebhookSecret         string
 	EnableAvailabilityJob bool
+
+	// Minutes, as text because the admin console has no number settings. Blank uses the default.
+	AvailabilityLookahead        string
+	AvailabilityRequiredDuration string
+	AvailabilityBufferBefore     string
+	AvailabilityBufferAfter      string
+	AvailabilityUseFreeBusy      bool
+}
+
+type AvailabilityOptions struct {
+	Lookahead        int `json:"lookahead"`
+	RequiredDuration int `json:"required_duration"`
+	BufferBefore     int `json:"buffer_before"`
+	BufferAfter      int `json:"buffer_after"`
+
+	// UseFreeBusy checks free/busy for right now instead of querying availability.
+	UseFreeBusy bool `json:"use_free_busy"`
+}
+
+const (
+	defaultAvailabilityLookahead        = 15
+	defaultAvailabilityRequiredDuration = 2
+	defaultAvailabilityBufferBefore     = 6
+	defaultAvailabilityBufferAfter      = 5
+
+	maxAvailabilityLookahead = 24 * 60
+	maxAvailabilityBuffer    = 4 * 60
+)
+
+func (c *configuration) getAvailabilityOptions() (*AvailabilityOptions, error) {
+	opts := &AvailabilityOptions{UseFreeBusy: c.AvailabilityUseFreeBusy}
+
+	settings := []struct {
+		name  string
+		value string
+		def   int
+		dest  *int
+	}{
+		{"Availability Lookahead", c.AvailabilityLookahead, defaultAvailabilityLookahead, &opts.Lookahead},
+		{"Availability Required Duration", c.AvailabilityRequiredDuration, defaultAvailabilityRequiredDuration, &opts.RequiredDuration},
+		{"Availability Buffer Before", c.AvailabilityBufferBefore, defaultAvailabilityBufferBefore, &opts.BufferBefore},
+		{"Availability Buffer After", c.AvailabilityBufferAfter, defaultAvailabilityBufferAfter, &opts.BufferAfter},
+	}
+
+	for _, s := range settings {
+		value := strings.TrimSpace(s.value)
+		if value == "" {
+			*s.dest = s.def
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Errorf("%s must be a whole number of minutes, not %q", s.name, s.value)
+		}
+		*s.dest = n
+	}
+
+	err := opts.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+func (opts *AvailabilityOptions) validate() error {
+	minLookahead := int(availabilityQueryDelay.Minutes()) + 1
+	if opts.Lookahead < minLookahead || opts.Lookahead > maxAvailabilityLookahead {
+		return fmt.Errorf("The availability lookahead must be between %d and %d minutes", minLookahead, maxAvailabilityLookahead)
+	}
+
+	maxDuration := opts.Lookahead - int(availabilityQueryDelay.Minutes())
+	if opts.RequiredDuration < 1 || opts.RequiredDuration > maxDuration {
+		return fmt.Errorf("The required free duration must be between 1 and %d minutes, to fit within the lookahead", maxDuration)
+	}
+
+	if opts.BufferBefore < 0 || opts.BufferBefore > maxAvailabilityBuffer || opts.BufferAfter < 0 || opts.BufferAfter > maxAvailabilityBuffer {
+		return fmt.Errorf("Availability buffers must be between 0 and %d minutes", maxAvailabilityBuffer)
+	}
+
+	return nil
 }
 
 func (c *configuration) Clone() *configuration {
@@ -52,9 +138,18 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	if _, err := configuration.getAvailabilityOptions(); err != nil {
+		return errors.Wrap(err, "invalid availability settings")
+	}
+
 	p.setConfiguration(configuration)
 
 	p.InitRecurringJob(configuration.EnableAvailabilityJob)
 
+	// Before activation, OnActivate performs the check instead.
+	if p.tokenManager != nil {
+		p.checkNotificationChannels()
+	}
+
 	return nil
 }
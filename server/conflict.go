@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const maxConflictViewActions = 3
+
+// needsConflictCheck only checks new and rescheduled events which are still to come.
+func needsConflictCheck(change *EventChange, loc *time.Location, now time.Time) bool {
+	evt := change.Event
+	if evt.Declined() || isEventRemoved(evt) {
+		return false
+	}
+
+	start, end, allDay, err := getEventTimes(evt, loc)
+	if err != nil || allDay || !end.After(now) || start.After(now.AddDate(0, 0, maxViewDays)) {
+		return false
+	}
+
+	for _, t := range change.Types {
+		switch t {
+		case EventChangeNewInvite, EventChangeNewEvent, EventChangeRescheduled:
+			return true
+		}
+	}
+
+	return false
+}
+
+func findChangeConflicts(h IHandler, userID string, changes []*EventChange, loc *time.Location) ([]*cronofy.Event, error) {
+	now := time.Now()
+
+	checked := []*EventChange{}
+	var from, to time.Time
+	for _, change := range changes {
+		if !needsConflictCheck(change, loc, now) {
+			continue
+		}
+
+		start, end, _, _ := getEventTimes(change.Event, loc)
+		if len(checked) == 0 || start.Before(from) {
+			from = start
+		}
+		if len(checked) == 0 || end.After(to) {
+			to = end
+		}
+		checked = append(checked, change)
+	}
+
+	if len(checked) == 0 {
+		return nil, nil
+	}
+
+	res, err := getUserEvents(h, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	all := []*cronofy.Event{}
+	for _, change := range checked {
+		change.Conflicts = findConflicts(change.Event, res.Events, loc)
+		for _, conflict := range change.Conflicts {
+			change.Details = append(change.Details, fmt.Sprintf("Conflicts with: \"%s\" %s", conflict.Summary, formatEventTimeRange(conflict, loc)))
+		}
+		all = append(all, change.Conflicts...)
+	}
+
+	return all, nil
+}
+
+func findConflicts(evt *cronofy.Event, events []*cronofy.Event, loc *time.Location) []*cronofy.Event {
+	candidates := []*cronofy.Event{evt}
+	for _, other := range events {
+		if other.EventUID != evt.EventUID {
+			candidates = append(candidates, other)
+		}
+	}
+
+	return findEventConflicts(candidates, loc)[evt.EventUID]
+}
+
+func getConflictAttachment(evt *cronofy.Event, conflicts []*cronofy.Event) *model.SlackAttachment {
+	attachment := &model.SlackAttachment{
+		Actions: []*model.PostAction{getParticipationAction(evt, "Decline this", "declined")},
+	}
+	addConflicts(attachment, evt, conflicts)
+
+	return attachment
+}
+
+func addConflicts(attachment *model.SlackAttachment, evt *cronofy.Event, conflicts []*cronofy.Event) {
+	summaries := []string{}
+	for _, conflict := range conflicts {
+		summaries = append(summaries, fmt.Sprintf(`"%s"`, conflict.Summary))
+	}
+
+	text := fmt.Sprintf(`"%s" conflicts with %s`, evt.Summary, strings.Join(summaries, ", "))
+	if attachment.Text != "" {
+		text = attachment.Text + "\n" + text
+	}
+	attachment.Text = text
+
+	for i, conflict := range conflicts {
+		if i == maxConflictViewActions {
+			break
+		}
+
+		name := "View conflicting event"
+		if len(conflicts) > 1 {
+			name = fmt.Sprintf(`View "%s"`, conflict.Summary)
+		}
+
+		attachment.Actions = append(attachment.Actions, &model.PostAction{
+			Type: model.POST_ACTION_TYPE_BUTTON,
+			Name: name,
+			Integration: &model.PostActionIntegration{
+				URL: "/plugins/cronofy" + routeViewEvent,
+				Context: map[string]interface{}{
+					"event_uid": conflict.EventUID,
+				},
+			},
+		})
+	}
+}
+
+func formatEventDetails(evt *cronofy.Event, loc *time.Location) string {
+	rows := []string{
+		fmt.Sprintf("#### \"%s\"", evt.Summary),
+		fmt.Sprintf("* **When:** %s", formatEventTimeRange(evt, loc)),
+	}
+
+	if location := evt.Location(); location != "" {
+		rows = append(rows, fmt.Sprintf("* **Location:** %s", location))
+	}
+
+	if organizer := formatPerson(evt.Organizer.DisplayName, evt.Organizer.Email); organizer != "" {
+		rows = append(rows, fmt.Sprintf("* **Organizer:** %s", organizer))
+	}
+
+	if len(evt.Attendees) > 0 {
+		rows = append(rows, fmt.Sprintf("* **Attendees:** %s", formatAttendees(evt)))
+	}
+
+	_, participationStatus := getEventBullets(evt)
+	if participationStatus != "" {
+		rows = append(rows, fmt.Sprintf("* **Your reply:** %s", strings.Title(participationStatus)))
+	}
+
+	return strings.Join(rows, "\n")
+}
+
+func httpViewEvent(h IHandler, w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := r.Header.Get("Mattermost-User-Id")
+	if mattermostUserID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	p := h.GetPlugin()
+
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != mattermostUserID {
+		return http.StatusBadRequest, errors.New("invalid post action request")
+	}
+
+	eid, _ := request.Context["event_uid"].(string)
+	if eid == "" {
+		return http.StatusBadRequest, errors.New("missing event in post action context")
+	}
+
+	response := &model.PostActionIntegrationResponse{}
+
+	evt, err := p.getEvent(mattermostUserID, eid)
+	if err != nil {
+		response.EphemeralText = "The event could not be found. It may have been removed."
+		return writePostActionResponse(w, response)
+	}
+
+	response.EphemeralText = formatEventDetails(evt, p.getUserLocation(mattermostUserID))
+	return writePostActionResponse(w, response)
+}
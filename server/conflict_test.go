@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflicts(t *testing.T) {
+	now := time.Date(2019, 11, 25, 9, 0, 0, 0, time.UTC)
+
+	invite := &cronofy.Event{EventUID: "invite", Summary: "Review", Start: "2019-11-25T10:00:00Z", End: "2019-11-25T11:00:00Z", ParticipationStatus: "needs_action"}
+	standup := &cronofy.Event{EventUID: "standup", Summary: "Standup", Start: "2019-11-25T10:30:00Z", End: "2019-11-25T10:45:00Z", ParticipationStatus: "accepted"}
+	declined := &cronofy.Event{EventUID: "declined", Summary: "Lunch", Start: "2019-11-25T10:00:00Z", End: "2019-11-25T11:00:00Z", ParticipationStatus: "declined"}
+	later := &cronofy.Event{EventUID: "later", Summary: "1:1", Start: "2019-11-25T11:00:00Z", End: "2019-11-25T11:30:00Z", ParticipationStatus: "accepted"}
+
+	// The invite's own stored copy isn't a conflict.
+	events := []*cronofy.Event{invite, standup, declined, later}
+	assert.Equal(t, []*cronofy.Event{standup}, findConflicts(invite, events, time.UTC))
+
+	change := &EventChange{Event: invite, Types: []EventChangeType{EventChangeNewInvite}}
+	assert.True(t, needsConflictCheck(change, time.UTC, now))
+	assert.False(t, needsConflictCheck(change, time.UTC, now.Add(3*time.Hour)), "event has ended")
+	assert.False(t, needsConflictCheck(&EventChange{Event: invite, Types: []EventChangeType{EventChangeLocationChanged}}, time.UTC, now))
+
+	change.Conflicts = []*cronofy.Event{standup}
+	rescheduled := &EventChange{Event: later, Types: []EventChangeType{EventChangeRescheduled}, Conflicts: []*cronofy.Event{standup, invite}}
+	attachments := getEventChangeAttachments([]*EventChange{change, rescheduled})
+	require.Len(t, attachments, 2)
+
+	assert.Contains(t, attachments[0].Text, `"Review" conflicts with "Standup"`)
+	require.Len(t, attachments[0].Actions, 4)
+	assert.Equal(t, "View conflicting event", attachments[0].Actions[3].Name)
+	assert.Equal(t, "standup", attachments[0].Actions[3].Integration.Context["event_uid"])
+
+	assert.Equal(t, `"1:1" conflicts with "Standup", "Review"`, attachments[1].Text)
+	require.Len(t, attachments[1].Actions, 3)
+	assert.Equal(t, "Decline this", attachments[1].Actions[0].Name)
+	assert.Equal(t, "declined", attachments[1].Actions[0].Integration.Context["participation"])
+	assert.Equal(t, `View "Review"`, attachments[1].Actions[2].Name)
+}
+
+func TestFindChangeConflicts(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api)
+
+	// An event and its conflict on the same day, so the range read from Cronofy is within one day.
+	day := startOfDay(time.Now().UTC().AddDate(0, 0, 2))
+	format := func(hours float64) string {
+		return day.Add(time.Duration(hours * float64(time.Hour))).Format(CRONOFY_DATETIME_FORMAT)
+	}
+	invite := &cronofy.Event{EventUID: "invite", Summary: "Review", Start: format(10), End: format(11), ParticipationStatus: "needs_action"}
+	standup := &cronofy.Event{EventUID: "standup", Summary: "Standup", Start: format(10.5), End: format(10.75), ParticipationStatus: "accepted"}
+
+	client := &fakeCronofyClient{
+		calendars: []*cronofy.Calendar{{CalendarID: "cal_1"}},
+		events:    []*cronofy.Event{invite, standup},
+	}
+	h := newFakeHandler(p, client)
+
+	change := &EventChange{Event: invite, Types: []EventChangeType{EventChangeNewInvite}}
+	conflicts, err := findChangeConflicts(h, "user1", []*EventChange{change}, time.UTC)
+	require.Nil(t, err)
+	assert.Equal(t, []*cronofy.Event{standup}, conflicts)
+
+	require.Len(t, client.requests, 1)
+	assert.Equal(t, day.Format(CRONOFY_DATE_FORMAT), *client.requests[0].From)
+	assert.Equal(t, day.AddDate(0, 0, 1).Format(CRONOFY_DATE_FORMAT), *client.requests[0].To)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	eventStartFormat     = "2006-01-02 15:04"
+	defaultEventDuration = "30m"
+	maxEventDuration     = 24 * time.Hour
+)
+
+func getWritableCalendars(calendars []*cronofy.Calendar) []*cronofy.Calendar {
+	writable := []*cronofy.Calendar{}
+	for _, c := range calendars {
+		if !c.ReadOnly && !c.Deleted {
+			writable = append(writable, c)
+		}
+	}
+
+	return writable
+}
+
+// parseEventStart reads "2019-11-25 09:30", or "09:30" for today, in the timezone of now.
+func parseEventStart(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	start, err := time.ParseInLocation(eventStartFormat, value, now.Location())
+	if err == nil {
+		return start, nil
+	}
+
+	t, err := time.Parse(agendaTimeFormat, value)
+	if err == nil {
+		return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location()), nil
+	}
+
+	return time.Time{}, errors.New("The start must be a date and time such as 2019-11-25 09:30, or a time today such as 09:30")
+}
+
+func parseEventDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		d, err = time.ParseDuration(value + "m")
+	}
+
+	if err != nil || d < time.Minute || d > maxEventDuration {
+		return 0, fmt.Errorf("The duration must be between 1 minute and %d hours, such as 30m or 1h30m", int(maxEventDuration.Hours()))
+	}
+
+	return d, nil
+}
+
+func resolveAttendees(p *Plugin, organizerID, value string) ([]EventAttendee, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+
+	attendees := []EventAttendee{}
+	hidden := []string{}
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "@") {
+			if !strings.Contains(field, "@") {
+				return nil, fmt.Errorf("%s is neither an @mention nor an email address", field)
+			}
+			attendees = append(attendees, EventAttendee{Email: field})
+			continue
+		}
+
+		user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(field, "@"))
+		if appErr != nil {
+			return nil, fmt.Errorf("No user found for %s", field)
+		}
+
+		attendee, ok := getUserAttendee(p, organizerID, user)
+		if !ok {
+			hidden = append(hidden, field)
+			continue
+		}
+		attendees = append(attendees, attendee)
+	}
+
+	if len(hidden) > 0 {
+		return nil, fmt.Errorf("Email addresses are hidden on this server, so %s can't be invited by @mention. Please use their email addresses.", strings.Join(hidden, ", "))
+	}
+
+	return attendees, nil
+}
+
+// getUserAttendee invites the user by email address, unless the organizer isn't allowed to see it.
+func getUserAttendee(p *Plugin, organizerID string, user *model.User) (EventAttendee, bool) {
+	showEmail := p.API.GetConfig().PrivacySettings.ShowEmailAddress
+	if user.Id != organizerID && showEmail != nil && !*showEmail && !p.API.HasPermissionTo(organizerID, model.PERMISSION_MANAGE_SYSTEM) {
+		return EventAttendee{}, false
+	}
+
+	return EventAttendee{Email: user.Email, DisplayName: user.GetFullName()}, true
+}
+
+func nextHalfHour(now time.Time) time.Time {
+	start := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	if now.Minute() < 30 {
+		return start.Add(30 * time.Minute)
+	}
+
+	return start.Add(time.Hour)
+}
+
+func openCreateEventDialog(h IHandler, header *model.CommandArgs, title string) error {
+	p := h.GetPlugin()
+
+	calendars, calendarErrs, err := getUserCalendars(h, header.UserId)
+	if err != nil {
+		return err
+	}
+
+	calendars = getWritableCalendars(calendars)
+	if len(calendars) == 0 && len(calendarErrs) > 0 {
+		return errors.New(strings.Join(calendarErrs, "\n"))
+	}
+	if len(calendars) == 0 {
+		return errors.New("None of your calendars can have events created in them.")
+	}
+
+	options := []*model.PostActionOptions{}
+	for _, c := range calendars {
+		options = append(options, &model.PostActionOptions{Text: formatCalendarName(c), Value: c.CalendarID})
+	}
+
+	now := time.Now().In(p.getUserLocation(header.UserId))
+
+	appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: header.TriggerId,
+		URL:       "/plugins/cronofy" + routeCreateEventDialog,
+		Dialog: model.Dialog{
+			Title:       "Create an event",
+			SubmitLabel: "Create",
+			Elements: []model.DialogElement{
+				{DisplayName: "Title", Name: "title", Type: "text", Default: title},
+				{
+					DisplayName: "Start",
+					Name:        "start",
+					Type:        "text",
+					Default:     nextHalfHour(now).Format(eventStartFormat),
+					HelpText:    fmt.Sprintf("A date and 24-hour time in %s, such as 2019-11-25 09:30.", now.Location()),
+				},
+				{DisplayName: "Duration", Name: "duration", Type: "text", Default: defaultEventDuration, HelpText: "Such as 30m or 1h30m."},
+				{DisplayName: "Calendar", Name: "calendar", Type: "select", Options: options, Default: calendars[0].CalendarID},
+				{
+					DisplayName: "Attendees",
+					Name:        "attendees",
+					Type:        "text",
+					HelpText:    "@mentions or email addresses, separated by commas.",
+					Optional:    true,
+				},
+				{DisplayName: "Location", Name: "location", Type: "text", Optional: true},
+				{DisplayName: "Description", Name: "description", Type: "textarea", Optional: true},
+			},
+		},
+	})
+	if appErr != nil {
+		return appErr
+	}
+
+	return nil
+}
+
+func httpSubmitCreateEventDialog(h IHandler, w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := r.Header.Get("Mattermost-User-Id")
+	if mattermostUserID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	p := h.GetPlugin()
+
+	request := model.SubmitDialogRequestFromJson(r.Body)
+	if request == nil || request.UserId != mattermostUserID {
+		return http.StatusBadRequest, errors.New("invalid dialog submission")
+	}
+
+	if request.Cancelled {
+		return http.StatusOK, nil
+	}
+
+	value := func(name string) string {
+		v, _ := request.Submission[name].(string)
+		return strings.TrimSpace(v)
+	}
+
+	loc := p.getUserLocation(mattermostUserID)
+
+	errs := map[string]string{}
+	if value("title") == "" {
+		errs["title"] = "Please enter a title."
+	}
+	start, err := parseEventStart(value("start"), time.Now().In(loc))
+	if err != nil {
+		errs["start"] = err.Error()
+	}
+	duration, err := parseEventDuration(value("duration"))
+	if err != nil {
+		errs["duration"] = err.Error()
+	}
+	attendees, err := resolveAttendees(p, mattermostUserID, value("attendees"))
+	if err != nil {
+		errs["attendees"] = err.Error()
+	}
+
+	if len(errs) > 0 {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Errors: errs})
+	}
+
+	calendars, _, err := getUserCalendars(h, mattermostUserID)
+	if err != nil {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Error: err.Error()})
+	}
+
+	var calendar *cronofy.Calendar
+	for _, c := range getWritableCalendars(calendars) {
+		if c.CalendarID == value("calendar") {
+			calendar = c
+		}
+	}
+	if calendar == nil {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Errors: map[string]string{"calendar": "Please choose one of your calendars."}})
+	}
+
+	req := &CreateEventRequest{
+		EventID:     model.NewId(),
+		Summary:     value("title"),
+		Description: value("description"),
+		Start:       start.UTC().Format(CRONOFY_DATETIME_FORMAT),
+		End:         start.Add(duration).UTC().Format(CRONOFY_DATETIME_FORMAT),
+		TZID:        loc.String(),
+	}
+	if value("location") != "" {
+		req.Location = &EventLocation{Description: value("location")}
+	}
+	if len(attendees) > 0 {
+		req.Attendees = &EventAttendees{Invite: attendees}
+	}
+
+	err = createUserEvent(h, mattermostUserID, calendar, req)
+	if err != nil {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Error: err.Error()})
+	}
+
+	return http.StatusOK, nil
+}
+
+func createUserEvent(h IHandler, userID string, calendar *cronofy.Calendar, req *CreateEventRequest) error {
+	p := h.GetPlugin()
+
+	client, err := getCalendarClient(h, userID, calendar.CalendarID)
+	if err != nil {
+		return err
+	}
+
+	err = createCalendarEvent(client, userID, calendar.CalendarID, req)
+	if err != nil {
+		return err
+	}
+
+	card := getEventCardAttachment(req, calendar, p.getUserLocation(userID))
+	_, err = p.CreateBotDMWithAttachments(userID, "Your event has been created.", []*model.SlackAttachment{card})
+	return err
+}
+
+func getEventCardAttachment(req *CreateEventRequest, calendar *cronofy.Calendar, loc *time.Location) *model.SlackAttachment {
+	evt := &cronofy.Event{Start: req.Start, End: req.End}
+
+	fields := []*model.SlackAttachmentField{
+		{Title: "When", Value: formatEventTimeRange(evt, loc), Short: true},
+		{Title: "Calendar", Value: formatCalendarName(calendar), Short: true},
+	}
+
+	if req.Location != nil {
+		fields = append(fields, &model.SlackAttachmentField{Title: "Location", Value: req.Location.Description, Short: true})
+	}
+
+	if req.Attendees != nil {
+		names := []string{}
+		for _, a := range req.Attendees.Invite {
+			names = append(names, formatPerson(a.DisplayName, a.Email))
+		}
+		fields = append(fields, &model.SlackAttachmentField{Title: "Attendees", Value: strings.Join(names, ", ")})
+	}
+
+	return &model.SlackAttachment{
+		Title:  req.Summary,
+		Text:   req.Description,
+		Fields: fields,
+		Actions: []*model.PostAction{{
+			Type: model.POST_ACTION_TYPE_BUTTON,
+			Name: "Delete event",
+			Integration: &model.PostActionIntegration{
+				URL: "/plugins/cronofy" + routeDeleteEvent,
+				Context: map[string]interface{}{
+					"calendar_id": calendar.CalendarID,
+					"event_id":    req.EventID,
+				},
+			},
+		}},
+	}
+}
+
+func httpDeleteEvent(h IHandler, w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := r.Header.Get("Mattermost-User-Id")
+	if mattermostUserID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	p := h.GetPlugin()
+
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != mattermostUserID {
+		return http.StatusBadRequest, errors.New("invalid post action request")
+	}
+
+	cid, _ := request.Context["calendar_id"].(string)
+	eid, _ := request.Context["event_id"].(string)
+	if cid == "" || eid == "" {
+		return http.StatusBadRequest, errors.New("missing event in post action context")
+	}
+
+	response := &model.PostActionIntegrationResponse{}
+
+	client, err := getCalendarClient(h, mattermostUserID, cid)
+	if err == nil {
+		err = deleteCalendarEvent(client, mattermostUserID, cid, eid)
+	}
+	if err != nil {
+		response.EphemeralText = fmt.Sprintf("Failed to delete the event: %s", err.Error())
+		return writePostActionResponse(w, response)
+	}
+
+	post, appErr := p.API.GetPost(request.PostId)
+	if appErr != nil {
+		response.EphemeralText = "The event has been deleted."
+		return writePostActionResponse(w, response)
+	}
+
+	markEventCardDeleted(post, eid)
+	response.Update = post
+
+	return writePostActionResponse(w, response)
+}
+
+func markEventCardDeleted(post *model.Post, eventID string) {
+	attachments := post.Attachments()
+	for _, attachment := range attachments {
+		for _, action := range attachment.Actions {
+			if action.Integration == nil || action.Integration.Context["event_id"] != eventID {
+				continue
+			}
+
+			attachment.Actions = nil
+			attachment.Fields = append(attachment.Fields, &model.SlackAttachmentField{Title: "Status", Value: "Deleted"})
+			break
+		}
+	}
+
+	model.ParseSlackAttachment(post, attachments)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateEvent(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.Nil(t, err)
+	now := time.Date(2019, 11, 25, 9, 10, 0, 0, berlin)
+
+	start, err := parseEventStart("2019-11-26 14:30", now)
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2019, 11, 26, 14, 30, 0, 0, berlin), start)
+
+	start, err = parseEventStart("16:00", now)
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2019, 11, 25, 16, 0, 0, 0, berlin), start)
+
+	_, err = parseEventStart("tomorrow", now)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, time.Date(2019, 11, 25, 9, 30, 0, 0, berlin), nextHalfHour(now))
+
+	duration, err := parseEventDuration("1h30m")
+	require.Nil(t, err)
+	assert.Equal(t, 90*time.Minute, duration)
+	duration, err = parseEventDuration("45")
+	require.Nil(t, err)
+	assert.Equal(t, 45*time.Minute, duration)
+	_, err = parseEventDuration("25h")
+	assert.NotNil(t, err)
+
+	api := newFakeAPI()
+	api.users["alice"] = &model.User{Id: "alice", Username: "alice", Email: "alice@example.com", FirstName: "Alice", LastName: "Smith"}
+	p := newTestPlugin(api)
+
+	attendees, err := resolveAttendees(p, "organizer", "@alice, bob@example.com")
+	require.Nil(t, err)
+	assert.Equal(t, []EventAttendee{{Email: "alice@example.com", DisplayName: "Alice Smith"}, {Email: "bob@example.com"}}, attendees)
+
+	_, err = resolveAttendees(p, "organizer", "@carol")
+	assert.EqualError(t, err, "No user found for @carol")
+	_, err = resolveAttendees(p, "organizer", "bob")
+	assert.NotNil(t, err)
+
+	// Mentions would reveal email addresses the server hides.
+	*api.config.PrivacySettings.ShowEmailAddress = false
+	_, err = resolveAttendees(p, "organizer", "@alice, bob@example.com")
+	assert.EqualError(t, err, "Email addresses are hidden on this server, so @alice can't be invited by @mention. Please use their email addresses.")
+	api.users["organizer"] = &model.User{Id: "organizer", Roles: model.SYSTEM_ADMIN_ROLE_ID}
+	_, err = resolveAttendees(p, "organizer", "@alice")
+	assert.Nil(t, err)
+
+	req := &CreateEventRequest{
+		EventID:   "event1",
+		Summary:   "Planning",
+		Start:     "2019-11-26T13:30:00Z",
+		End:       "2019-11-26T14:00:00Z",
+		Attendees: &EventAttendees{Invite: attendees},
+	}
+	calendar := &cronofy.Calendar{CalendarID: "cal1", CalendarName: "Work", ProfileName: "alice@example.com"}
+	card := getEventCardAttachment(req, calendar, berlin)
+	assert.Equal(t, "Planning", card.Title)
+	assert.Equal(t, "Tuesday November 26 2:30 PM - 3:00 PM", card.Fields[0].Value)
+	assert.Equal(t, "Alice Smith (alice@example.com), bob@example.com", card.Fields[2].Value)
+	require.Len(t, card.Actions, 1)
+	assert.Equal(t, "event1", card.Actions[0].Integration.Context["event_id"])
+
+	post := &model.Post{}
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{card})
+	markEventCardDeleted(post, "event1")
+	assert.Empty(t, post.Attachments()[0].Actions)
+	assert.Equal(t, "Deleted", post.Attachments()[0].Fields[3].Value)
+}
+
+func TestCreateCommand(t *testing.T) {
+	api := newFakeAPI()
+	api.users["user1"] = &model.User{Id: "user1", Username: "user1"}
+	p := newTestPlugin(api)
+	require.Nil(t, p.storeCronofyUser("user1", &CronofyUser{Accounts: []*CronofyAccount{{AccessTokenResponse: AccessTokenResponse{AccountId: "acc_1"}}}}))
+
+	client := &fakeCronofyClient{calendars: []*cronofy.Calendar{
+		{CalendarID: "cal_1", CalendarName: "Holidays", ReadOnly: true},
+		{CalendarID: "cal_2", CalendarName: "Work"},
+	}}
+	h := newFakeHandler(p, client)
+
+	header := &model.CommandArgs{UserId: "user1", ChannelId: "channel1", TriggerId: "trigger1"}
+	commandHandler.Handle(h, nil, header, "create", "Quarterly", "planning")
+
+	assert.Empty(t, api.ephemeralPosts)
+	require.Len(t, api.dialogs, 1)
+	dialog := api.dialogs[0]
+	assert.Equal(t, "trigger1", dialog.TriggerId)
+	assert.Equal(t, "/plugins/cronofy"+routeCreateEventDialog, dialog.URL)
+	assert.Equal(t, "Quarterly planning", dialog.Dialog.Elements[0].Default)
+	assert.Equal(t, "cal_2", dialog.Dialog.Elements[3].Default)
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/jeffreylo/cronofy"
@@ -28,40 +34,260 @@ type WebhookMessage struct {
 	Channel      NotificationChannel `json:"channel"`
 }
 
-func createNotificationChannel(h IHandler, userID string) (string, error) {
+func getNotificationCallbackURL(p *Plugin, userID, accountID string) string {
+	params := url.Values{}
+	params.Add("user_id", userID)
+	params.Add("account_id", accountID)
+
+	return fmt.Sprintf("%s/plugins/cronofy/webhook?%s", p.getSiteURL(), params.Encode())
+}
+
+func createNotificationChannel(h IHandler, userID string, ac *AccountClient) (*NotificationChannel, error) {
 	p := h.GetPlugin()
 
 	reqURL := "https://api.cronofy.com/v1/channels"
-	secret := p.getConfiguration().InternalSecret
 
-	cronofyUser, err := h.GetPlugin().getCronofyUser(userID)
+	payload := map[string]string{
+		"callback_url": getNotificationCallbackURL(p, userID, ac.Account.AccountId),
+	}
+
+	status, data, err := ac.Client.CronofyRequest(userID, reqURL, payload)
+	if err != nil {
+		return nil, err
+	} else if status >= 300 {
+		return nil, fmt.Errorf("Cronofy returned status %d %s", status, string(data))
+	}
+
+	var res struct {
+		Channel NotificationChannel `json:"channel"`
+	}
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res.Channel, nil
+}
+
+func getNotificationChannels(client ICronofyClient, userID string) ([]NotificationChannel, error) {
+	reqURL := "https://api.cronofy.com/v1/channels"
+
+	status, data, err := client.CronofyRequestWithMethod(userID, http.MethodGet, reqURL, nil)
 	if err != nil {
-		return "", err
+		return nil, err
+	} else if status >= 300 {
+		return nil, fmt.Errorf("Cronofy returned status %d %s", status, string(data))
 	}
-	accessToken := cronofyUser.AccessToken
+
+	var res struct {
+		Channels []NotificationChannel `json:"channels"`
+	}
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Channels, nil
+}
+
+func closeNotificationChannel(client ICronofyClient, userID, channelID string) error {
+	reqURL := "https://api.cronofy.com/v1/channels/" + url.PathEscape(channelID)
+
+	status, data, err := client.CronofyRequestWithMethod(userID, http.MethodDelete, reqURL, nil)
+	if err != nil {
+		return err
+	} else if status >= 300 {
+		return fmt.Errorf("Cronofy returned status %d %s", status, string(data))
+	}
+
+	return nil
+}
+
+func revokeProfile(client ICronofyClient, userID, profileID string) error {
+	reqURL := fmt.Sprintf("https://api.cronofy.com/v1/profiles/%s/revoke", url.PathEscape(profileID))
+
+	status, data, err := client.CronofyRequestWithMethod(userID, http.MethodPost, reqURL, nil)
+	if err != nil {
+		return err
+	} else if status >= 300 {
+		return fmt.Errorf("Cronofy returned status %d %s", status, string(data))
+	}
+
+	return nil
+}
+
+type EventLocation struct {
+	Description string `json:"description"`
+}
+
+type EventAttendee struct {
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+type EventAttendees struct {
+	Invite []EventAttendee `json:"invite"`
+}
+
+type CreateEventRequest struct {
+	EventID     string          `json:"event_id"`
+	Summary     string          `json:"summary"`
+	Description string          `json:"description"`
+	Start       string          `json:"start"`
+	End         string          `json:"end"`
+	TZID        string          `json:"tzid"`
+	Location    *EventLocation  `json:"location,omitempty"`
+	Attendees   *EventAttendees `json:"attendees,omitempty"`
+}
+
+// errEventWriteNotAllowed is returned for accounts connected before the plugin asked for write access.
+var errEventWriteNotAllowed = errors.New("The plugin isn't allowed to change events in this calendar. Please run `/cronofy connect` to connect your calendar again.")
+
+func createCalendarEvent(client ICronofyClient, userID, calendarID string, req *CreateEventRequest) error {
+	reqURL := fmt.Sprintf("https://api.cronofy.com/v1/calendars/%s/events", url.PathEscape(calendarID))
+
+	status, data, err := client.CronofyRequest(userID, reqURL, req)
+	if err != nil {
+		return err
+	} else if status == http.StatusForbidden {
+		return errEventWriteNotAllowed
+	} else if status >= 300 {
+		return fmt.Errorf("Cronofy returned status %d %s", status, string(data))
+	}
+
+	return nil
+}
+
+func deleteCalendarEvent(client ICronofyClient, userID, calendarID, eventID string) error {
+	reqURL := fmt.Sprintf("https://api.cronofy.com/v1/calendars/%s/events", url.PathEscape(calendarID))
 
 	payload := map[string]string{
-		"callback_url": fmt.Sprintf("%s/plugins/cronofy/webhook?user_id=%s&secret=%s", p.getSiteURL(), userID, secret),
+		"event_id": eventID,
+	}
+
+	status, data, err := client.CronofyRequestWithMethod(userID, http.MethodDelete, reqURL, payload)
+	if err != nil {
+		return err
+	} else if status == http.StatusForbidden {
+		return errEventWriteNotAllowed
+	} else if status >= 300 {
+		return fmt.Errorf("Cronofy returned status %d %s", status, string(data))
 	}
 
-	client := h.MakeCronofyClient(accessToken)
-	_, body, err := client.CronofyRequest(userID, reqURL, payload)
+	return nil
+}
+
+func getCalendarClient(h IHandler, userID, calendarID string) (ICronofyClient, error) {
+	clients, err := h.MakeUserCronofyClients(userID)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	for _, ac := range clients {
+		calendars, err := ac.Client.GetCalendars()
+		if err != nil {
+			continue
+		}
+
+		for _, c := range calendars {
+			if c.CalendarID == calendarID {
+				return ac.Client, nil
+			}
+		}
+	}
+
+	return nil, errors.New("No linked account has access to this calendar")
+}
+
+// getWebhookAccountClients returns every account for channels created before they named one.
+func getWebhookAccountClients(h IHandler, userID, accountID string) ([]*AccountClient, error) {
+	clients, err := h.MakeUserCronofyClients(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if accountID == "" {
+		return clients, nil
 	}
 
-	return string(body), nil
+	for _, ac := range clients {
+		if ac.Account.AccountId == accountID {
+			return []*AccountClient{ac}, nil
+		}
+	}
+
+	return nil, errors.New("The notification channel's account is no longer linked")
 }
 
-func getCalendarInfo(accessToken string, calendarIDs []string) (*cronofy.EventsResponse, error) {
-	now := time.Now().UTC()
-	from := now.Format("2006-01-02")
-	end := now.Add(7 * 24 * time.Hour)
-	to := end.Format("2006-01-02")
-	client := NewCronofyClient(accessToken)
+type UserEvents struct {
+	Calendars    []*cronofy.Calendar
+	Events       []*cronofy.Event
+	Conferencing map[string]*Conferencing
+	Location     *time.Location
+	Errors       []string
+}
+
+func getUserEvents(h IHandler, userID string, from, to time.Time) (*UserEvents, error) {
+	clients, err := h.MakeUserCronofyClients(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := h.GetPlugin().getUserSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &UserEvents{
+		Conferencing: map[string]*Conferencing{},
+		Location:     h.GetPlugin().getUserLocation(userID),
+	}
+	for _, ac := range clients {
+		calendars, err := ac.Client.GetCalendars()
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("Error fetching calendars for %s: %s", ac.Account.describeProfiles(), err.Error()))
+			continue
+		}
+
+		calendars = settings.filterCalendars(calendars)
+
+		if len(calendars) == 0 {
+			continue
+		}
+
+		calendarIDs := []string{}
+		for _, c := range calendars {
+			calendarIDs = append(calendarIDs, c.CalendarID)
+		}
+
+		events, err := getCalendarInfo(ac.Client, calendarIDs, from, to, res.Location)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("Error fetching events for %s: %s", ac.Account.describeProfiles(), err.Error()))
+			continue
+		}
+
+		res.Calendars = append(res.Calendars, calendars...)
+		res.Events = append(res.Events, events.Events...)
+		for uid, conferencing := range events.Conferencing {
+			res.Conferencing[uid] = conferencing
+		}
+	}
+
+	return res, nil
+}
+
+// getCalendarInfo reads whole days in loc, so events may start or end outside the times.
+func getCalendarInfo(client ICronofyClient, calendarIDs []string, fromTime, toTime time.Time, loc *time.Location) (*EventsResponse, error) {
+	toTime = toTime.In(loc)
+	if day := startOfDay(toTime); toTime.After(day) {
+		toTime = day.AddDate(0, 0, 1)
+	}
+
+	from := fromTime.In(loc).Format(CRONOFY_DATE_FORMAT)
+	to := toTime.Format(CRONOFY_DATE_FORMAT)
 
 	res, err := client.GetEvents(&cronofy.EventsRequest{
-		TZID:        "UTC",
+		TZID:        loc.String(),
 		From:        &from,
 		To:          &to,
 		CalendarIDs: calendarIDs,
@@ -80,23 +306,36 @@ func httpWebhook(h IHandler, w http.ResponseWriter, r *http.Request) (int, error
 	p := h.GetPlugin()
 
 	mattermostUserID := r.URL.Query().Get("user_id")
-	secret := r.URL.Query().Get("secret")
-	storedSecret := p.getConfiguration().InternalSecret
-	if mattermostUserID == "" || secret != storedSecret {
+	if mattermostUserID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if !isWebhookAuthorized(p, r, data) {
 		return http.StatusUnauthorized, errors.New("not authorized")
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	var body WebhookMessage
-	err := decoder.Decode(&body)
+	err = json.Unmarshal(data, &body)
 	if err != nil {
 		p.CreateBotDMtoMMUserId(mattermostUserID, err.Error())
 		return http.StatusInternalServerError, err
 	}
 
+	accountID := r.URL.Query().Get("account_id")
+
+	// The signature only covers the body, so the user and account in the URL must match its channel.
+	if r.Header.Get("Cronofy-HMAC-SHA256") != "" && !isWebhookChannelOwned(p, mattermostUserID, accountID, body) {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
 	switch body.Notification.Type {
 	case "change":
-		return handleWebhookEventChange(h, mattermostUserID, body)
+		return handleWebhookEventChange(h, mattermostUserID, accountID, body)
 	case "verification":
 		return handleWebhookVerification(h, mattermostUserID, body)
 	}
@@ -104,138 +343,153 @@ func httpWebhook(h IHandler, w http.ResponseWriter, r *http.Request) (int, error
 	return http.StatusNotFound, fmt.Errorf("Unsupported webhook message type: %s", body.Notification.Type)
 }
 
-func handleWebhookEventChange(h IHandler, mattermostUserID string, body WebhookMessage) (int, error) {
-	p := h.GetPlugin()
+// isWebhookAuthorized falls back to the callback URL secret for channels created before signing.
+func isWebhookAuthorized(p *Plugin, r *http.Request, body []byte) bool {
+	signature := r.Header.Get("Cronofy-HMAC-SHA256")
+	if signature != "" {
+		return verifyWebhookSignature(body, signature, p.getConfiguration().ClientSecret)
+	}
 
-	cronofyUser, err := p.getCronofyUser(mattermostUserID)
-	if err != nil {
-		return http.StatusInternalServerError, err
+	storedSecret := p.getConfiguration().WebhookSecret
+	secret := r.URL.Query().Get("secret")
+	return storedSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(storedSecret)) == 1
+}
+
+// isWebhookChannelOwned checks verifications by callback URL, as their channel isn't stored yet.
+func isWebhookChannelOwned(p *Plugin, userID, accountID string, body WebhookMessage) bool {
+	if body.Notification.Type == "verification" {
+		callbackURL, err := url.Parse(body.Channel.CallbackUrl)
+		if err != nil {
+			return false
+		}
+		query := callbackURL.Query()
+		return query.Get("user_id") == userID && query.Get("account_id") == accountID
 	}
-	accessToken := cronofyUser.AccessToken
 
-	lastMod, err := time.Parse(CRONOFY_DATETIME_FORMAT, body.Notification.ChangesSince)
+	channels, err := p.getUserNotificationChannels(userID)
 	if err != nil {
-		p.CreateBotDMtoMMUserId(mattermostUserID, err.Error())
-		return http.StatusInternalServerError, err
+		return false
 	}
 
-	client := NewCronofyClient(accessToken)
+	channel, ok := channels[accountID]
+	return ok && body.Channel.ChannelId != "" && channel.ChannelId == body.Channel.ChannelId
+}
 
-	res, err := client.GetEvents(&cronofy.EventsRequest{
-		TZID:         "UTC",
-		LastModified: &lastMod,
-	})
-	if err != nil {
-		p.CreateBotDMtoMMUserId(mattermostUserID, err.Error())
-		return http.StatusInternalServerError, err
+// verifyWebhookSignature accepts any of the comma-separated signatures sent during secret rotation.
+func verifyWebhookSignature(body []byte, signatureHeader, clientSecret string) bool {
+	if clientSecret == "" {
+		return false
 	}
 
-	if len(res.Events) == 0 {
-		p.CreateBotDMtoMMUserId(mattermostUserID, "A calendar event was deleted")
-		return http.StatusOK, nil
+	mac := hmac.New(sha256.New, []byte(clientSecret))
+	_, _ = mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, signature := range strings.Split(signatureHeader, ",") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+		if err == nil && hmac.Equal(decoded, expected) {
+			return true
+		}
 	}
 
-	p.storeEvents(res.Events)
+	return false
+}
 
-	evt := res.Events[0]
+func handleWebhookEventChange(h IHandler, mattermostUserID, accountID string, body WebhookMessage) (int, error) {
+	p := h.GetPlugin()
 
-	if lastMod.Sub(evt.Created).Seconds() > 10 && false {
-		text := fmt.Sprintf(`Event "%s" has been updated.`, evt.Summary)
-		p.CreateBotDMtoMMUserId(mattermostUserID, text)
-		return http.StatusOK, nil
+	clients, err := getWebhookAccountClients(h, mattermostUserID, accountID)
+	if err != nil {
+		return http.StatusInternalServerError, err
 	}
 
-	if evt.ParticipationStatus != "needs_action" {
-		text := fmt.Sprintf(`Event "%s" has changed. You have already replied: %s`, evt.Summary, evt.ParticipationStatus)
-		p.CreateBotDMtoMMUserId(mattermostUserID, text)
-		return http.StatusOK, nil
+	lastMod, err := time.Parse(CRONOFY_DATETIME_FORMAT, body.Notification.ChangesSince)
+	if err != nil {
+		p.CreateBotDMtoMMUserId(mattermostUserID, err.Error())
+		return http.StatusInternalServerError, err
 	}
 
-	text := getParticipationLinksString(evt)
-
-	p.CreateBotDMtoMMUserId(mattermostUserID, text)
-
-	return http.StatusOK, nil
-}
-
-func getParticipationLinksString(evt *cronofy.Event) string {
-	params := url.Values{}
-	params.Add("calendar_id", evt.CalendarID)
-	params.Add("event_uid", evt.EventUID)
-	s := params.Encode()
-
-	acceptUrl := "/plugins/cronofy/participation?" + s + "&participation=accepted"
-	declineUrl := "/plugins/cronofy/participation?" + s + "&participation=declined"
-	tentativeUrl := "/plugins/cronofy/participation?" + s + "&participation=tentative"
-	text := fmt.Sprintf(`%s has invited you for "%s" [Accept](%s) [Decline](%s) [Tentative](%s)`, evt.Organizer.Email, evt.Summary, acceptUrl, declineUrl, tentativeUrl)
-	return text
-}
+	loc := p.getUserLocation(mattermostUserID)
+	includeDeleted := true
+	res := &cronofy.EventsResponse{}
+	conferencing := map[string]*Conferencing{}
+	for _, ac := range clients {
+		accountRes, err := ac.Client.GetEvents(&cronofy.EventsRequest{
+			TZID:           loc.String(),
+			LastModified:   &lastMod,
+			IncludeDeleted: &includeDeleted,
+		})
+		if err != nil {
+			p.CreateBotDMtoMMUserId(mattermostUserID, err.Error())
+			return http.StatusInternalServerError, err
+		}
 
-func handleWebhookVerification(h IHandler, mattermostUserID string, body WebhookMessage) (int, error) {
-	h.GetPlugin().CreateBotDMtoMMUserId(mattermostUserID, "You will now receive notifications from your calendar!")
-	return http.StatusOK, nil
-}
+		res.Events = append(res.Events, accountRes.Events...)
+		for uid, c := range accountRes.Conferencing {
+			conferencing[uid] = c
+		}
+	}
 
-func httpSetParticipation(h IHandler, w http.ResponseWriter, r *http.Request) (int, error) {
-	mattermostUserID := r.Header.Get("Mattermost-User-Id")
-	if mattermostUserID == "" {
-		return http.StatusUnauthorized, errors.New("not authorized")
+	if len(res.Events) == 0 {
+		return http.StatusOK, nil
 	}
 
-	p := h.GetPlugin()
+	previous, err := p.getEvents(mattermostUserID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
 
-	q := r.URL.Query()
-	participation := q.Get("participation")
-	cid := q.Get("calendar_id")
-	eid := q.Get("event_uid")
+	changes := diffEvents(previous, res.Events, loc)
 
-	body := map[string]string{
-		"status": participation,
+	err = p.storeEvents(mattermostUserID, res.Events)
+	if err != nil {
+		return http.StatusInternalServerError, err
 	}
 
-	cronofyUser, err := h.GetPlugin().getCronofyUser(mattermostUserID)
+	settings, err := p.getUserSettings(mattermostUserID)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	accessToken := cronofyUser.AccessToken
 
-	client := NewCronofyClient(accessToken)
-
-	reqURL := fmt.Sprintf("https://api.cronofy.com/v1/calendars/%s/events/%s/participation_status", cid, eid)
-	status, _, err := client.CronofyRequest(mattermostUserID, reqURL, body)
-	if err != nil {
-		p.CreateBotDMtoMMUserId(mattermostUserID, err.Error())
+	if settings.ReminderMinutes > 0 || settings.CustomStatus {
+		err = rescheduleReminders(h, mattermostUserID, settings, res.Events, conferencing)
+		if err != nil {
+			p.API.LogWarn("Failed to reschedule reminders", "user_id", mattermostUserID, "error", err.Error())
+		}
 	}
 
-	var text string
+	changes = settings.filterChanges(changes)
 
-	if status != http.StatusAccepted {
-		text = "Failed to change event's status."
-		p.CreateBotDMtoMMUserId(mattermostUserID, text)
-		w.Write([]byte(makeHTMLResponse(h, mattermostUserID, text, "")))
-		return status, errors.New(text)
+	if len(changes) == 0 {
+		return http.StatusOK, nil
 	}
 
-	text = fmt.Sprintf(`Successfully set status to %s`, participation)
-	providerName := ""
-	evt, err := p.getEvent(eid)
-	if err == nil && evt != nil {
-		startTime, _ := time.Parse(CRONOFY_DATETIME_FORMAT, evt.Start)
-		startTimeStr := startTime.Format(DEFAULT_TIME_FORMAT)
-		startDateStr := startTime.Format(DEFAULT_DATE_FORMAT)
+	conflicts, err := findChangeConflicts(h, mattermostUserID, changes, loc)
+	if err != nil {
+		p.API.LogWarn("Failed to check events for conflicts", "user_id", mattermostUserID, "error", err.Error())
+	}
 
-		text = fmt.Sprintf(`Successfully set status to %s, for "%s" with %s on %s at %s`, participation, evt.Summary, evt.Organizer.Email, startDateStr, startTimeStr)
+	if len(conflicts) > 0 {
+		// The conflicting events are stored so they can be viewed from the notification.
+		err = p.storeEvents(mattermostUserID, conflicts)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
 	}
 
-	w.Write([]byte(makeHTMLResponse(h, mattermostUserID, text, providerName)))
-	p.CreateBotDMtoMMUserId(mattermostUserID, text)
+	p.CreateBotDMWithAttachments(mattermostUserID, formatEventChanges(changes, loc), getEventChangeAttachments(changes))
+
+	return http.StatusOK, nil
+}
 
+func handleWebhookVerification(h IHandler, mattermostUserID string, body WebhookMessage) (int, error) {
+	h.GetPlugin().CreateBotDMtoMMUserId(mattermostUserID, "You will now receive notifications from your calendar!")
 	return http.StatusOK, nil
 }
 
 type AvailabilityParticipantMember struct {
 	Sub         string   `json:"sub"`
-	CalendarIDs []string `json:"calendar_ids"`
+	CalendarIDs []string `json:"calendar_ids,omitempty"`
 }
 
 type AvailabilityParticipant struct {
@@ -262,21 +516,37 @@ type AvailabilityRequest struct {
 	RequiredDuration AvailabilityDuration      `json:"required_duration"`
 	AvailablePeriods []AvailabilityPeriod      `json:"available_periods"`
 	Buffer           AvailabilityBuffer        `json:"buffer"`
+	ResponseFormat   string                    `json:"response_format,omitempty"`
 }
 
 type AvailabilityResponse struct {
 	AvailablePeriods []AvailabilityPeriod            `json:"available_periods"`
+	AvailableSlots   []AvailabilityPeriod            `json:"available_slots"`
 	Participants     []AvailabilityParticipantMember `json:"participants"`
 }
 
-func buildAvailabilityRequest(sub string, calendarIDs []string) (AvailabilityRequest, error) {
+type FreeBusyPeriod struct {
+	CalendarID     string `json:"calendar_id"`
+	Start          string `json:"start"`
+	End            string `json:"end"`
+	FreeBusyStatus string `json:"free_busy_status"`
+}
+
+type FreeBusyResponse struct {
+	FreeBusy []FreeBusyPeriod `json:"free_busy"`
+}
+
+// availabilityQueryDelay keeps the query start in the future, as Cronofy rejects past periods.
+const availabilityQueryDelay = 2 * time.Minute
+
+func buildAvailabilityRequest(sub string, calendarIDs []string, opts *AvailabilityOptions, now time.Time) (AvailabilityRequest, error) {
 	member := AvailabilityParticipantMember{
 		Sub:         sub,
 		CalendarIDs: calendarIDs,
 	}
 	availablePeriods := []AvailabilityPeriod{AvailabilityPeriod{
-		Start: time.Now().Add(time.Minute * 2).UTC().Format(CRONOFY_DATETIME_FORMAT),
-		End:   time.Now().Add(time.Minute * 15).UTC().Format(CRONOFY_DATETIME_FORMAT),
+		Start: now.Add(availabilityQueryDelay).UTC().Format(CRONOFY_DATETIME_FORMAT),
+		End:   now.Add(time.Duration(opts.Lookahead) * time.Minute).UTC().Format(CRONOFY_DATETIME_FORMAT),
 	}}
 
 	return AvailabilityRequest{
@@ -284,42 +554,99 @@ func buildAvailabilityRequest(sub string, calendarIDs []string) (AvailabilityReq
 			Members:  []AvailabilityParticipantMember{member},
 			Required: "all",
 		}},
-		RequiredDuration: AvailabilityDuration{Minutes: 2},
+		RequiredDuration: AvailabilityDuration{Minutes: opts.RequiredDuration},
 		AvailablePeriods: availablePeriods,
 		Buffer: AvailabilityBuffer{
-			Before: AvailabilityDuration{Minutes: 6},
-			After:  AvailabilityDuration{Minutes: 5},
+			Before: AvailabilityDuration{Minutes: opts.BufferBefore},
+			After:  AvailabilityDuration{Minutes: opts.BufferAfter},
 		},
 	}, nil
 }
 
+func (p *Plugin) getUserAvailabilityOptions(settings *UserSettings) (*AvailabilityOptions, error) {
+	defaults, err := p.getConfiguration().getAvailabilityOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := settings.Availability.apply(defaults)
+	err = opts.validate()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Your availability settings are no longer valid. Run `/cronofy availability reset` to use the defaults")
+	}
+
+	return opts, nil
+}
+
 func getUserAvailabilityStatus(h IHandler, userID string) (*AvailabilityResponse, error) {
-	p := h.GetPlugin()
+	clients, err := h.MakeUserCronofyClients(userID)
+	if err != nil {
+		return nil, err
+	}
 
-	info, err := p.getCronofyUser(userID)
+	settings, err := h.GetPlugin().getUserSettings(userID)
 	if err != nil {
 		return nil, err
 	}
 
-	accessToken := info.AccessToken
-	client := NewCronofyClient(accessToken)
+	opts, err := h.GetPlugin().getUserAvailabilityOptions(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().In(h.GetPlugin().getUserLocation(userID))
+	var merged *AvailabilityResponse
+	for _, ac := range clients {
+		var av *AvailabilityResponse
+		if opts.UseFreeBusy {
+			av, err = getAccountFreeBusyStatus(ac, userID, settings, opts, now)
+		} else {
+			av, err = getAccountAvailabilityStatus(ac, userID, settings, opts, now)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if av == nil {
+			continue
+		}
+
+		if merged == nil {
+			merged = av
+			continue
+		}
+
+		merged.AvailablePeriods = intersectAvailablePeriods(merged.AvailablePeriods, av.AvailablePeriods)
+		merged.Participants = append(merged.Participants, av.Participants...)
+	}
+
+	if merged == nil {
+		return nil, errors.New("No calendars found")
+	}
+
+	return merged, nil
+}
+
+// getAccountAvailabilityStatus returns nil when the account has no included calendars.
+func getAccountAvailabilityStatus(ac *AccountClient, userID string, settings *UserSettings, opts *AvailabilityOptions, now time.Time) (*AvailabilityResponse, error) {
+	client := ac.Client
 
 	calendars, err := client.GetCalendars()
 	if err != nil {
 		return nil, err
 	}
 
+	calendars = settings.filterCalendars(calendars)
 	if len(calendars) == 0 {
-		return nil, errors.New("No calendars found")
+		return nil, nil
 	}
 
-	sub := info.Sub
+	sub := ac.Account.Sub
 	calendarIDs := []string{}
 	for _, c := range calendars {
 		calendarIDs = append(calendarIDs, c.CalendarID)
 	}
 
-	req, err := buildAvailabilityRequest(sub, calendarIDs)
+	req, err := buildAvailabilityRequest(sub, calendarIDs, opts, now)
 	if err != nil {
 		return nil, err
 	}
@@ -342,37 +669,116 @@ func getUserAvailabilityStatus(h IHandler, userID string) (*AvailabilityResponse
 	return av, nil
 }
 
-func updateUserStatusWithAvailabilities(h IHandler, userID string, availabilities *AvailabilityResponse) (string, error) {
-	p := h.GetPlugin()
+// getAccountFreeBusyStatus returns nil when the account has no included calendars.
+func getAccountFreeBusyStatus(ac *AccountClient, userID string, settings *UserSettings, opts *AvailabilityOptions, now time.Time) (*AvailabilityResponse, error) {
+	client := ac.Client
+
+	calendars, err := client.GetCalendars()
+	if err != nil {
+		return nil, err
+	}
 
-	prevStatus, appErr := p.API.GetUserStatus(userID)
-	if appErr != nil {
-		return "", appErr
+	calendars = settings.filterCalendars(calendars)
+	if len(calendars) == 0 {
+		return nil, nil
 	}
 
-	if len(availabilities.AvailablePeriods) == 0 {
-		if prevStatus.Status == "dnd" {
-			return "User is not available. User is already DND.", nil
+	// Free/busy is queried by date, so include the days either side of now.
+	query := url.Values{}
+	query.Set("tzid", now.Location().String())
+	query.Set("from", now.AddDate(0, 0, -1).Format(CRONOFY_DATE_FORMAT))
+	query.Set("to", now.AddDate(0, 0, 2).Format(CRONOFY_DATE_FORMAT))
+	for _, c := range calendars {
+		query.Add("calendar_ids[]", c.CalendarID)
+	}
+
+	reqURL := "https://api.cronofy.com/v1/free_busy?" + query.Encode()
+	status, data, err := client.CronofyRequestWithMethod(userID, http.MethodGet, reqURL, nil)
+
+	if err != nil {
+		return nil, err
+	} else if status >= 300 {
+		return nil, fmt.Errorf("Cronofy returned status %d %s", status, string(data))
+	}
+
+	res := &FreeBusyResponse{}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		return nil, err
+	}
+
+	av := &AvailabilityResponse{
+		Participants: []AvailabilityParticipantMember{{Sub: ac.Account.Sub}},
+	}
+	if isBusyAt(res.FreeBusy, opts, now) {
+		return av, nil
+	}
+
+	av.AvailablePeriods = []AvailabilityPeriod{{
+		Start: now.UTC().Format(CRONOFY_DATETIME_FORMAT),
+		End:   now.Add(time.Duration(opts.Lookahead) * time.Minute).UTC().Format(CRONOFY_DATETIME_FORMAT),
+	}}
+	return av, nil
+}
+
+func isBusyAt(periods []FreeBusyPeriod, opts *AvailabilityOptions, t time.Time) bool {
+	before := time.Duration(opts.BufferBefore) * time.Minute
+	after := time.Duration(opts.BufferAfter) * time.Minute
+
+	for _, period := range periods {
+		if period.FreeBusyStatus == "free" {
+			continue
 		}
 
-		nextStatus, appErr := p.API.UpdateUserStatus(userID, "dnd")
-		if appErr != nil {
-			return "", appErr
+		start, _, err1 := parseEventTime(period.Start, t.Location())
+		end, _, err2 := parseEventTime(period.End, t.Location())
+		if err1 != nil || err2 != nil {
+			continue
 		}
 
-		return fmt.Sprintf(`User is not available. Old status "%s", New status "%s"`, prevStatus.Status, nextStatus.Status), nil
+		if !t.Before(start.Add(-before)) && t.Before(end.Add(after)) {
+			return true
+		}
 	}
 
-	if prevStatus.Status != "dnd" {
-		return fmt.Sprintf(`User is available. Status is still %s`, prevStatus.Status), nil
-	}
+	return false
+}
+
+func intersectAvailablePeriods(a, b []AvailabilityPeriod) []AvailabilityPeriod {
+	result := []AvailabilityPeriod{}
+	for _, pa := range a {
+		aStart, err1 := time.Parse(CRONOFY_DATETIME_FORMAT, pa.Start)
+		aEnd, err2 := time.Parse(CRONOFY_DATETIME_FORMAT, pa.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
 
-	nextStatus, appErr := p.API.UpdateUserStatus(userID, "online")
-	if appErr != nil {
-		return "", appErr
+		for _, pb := range b {
+			bStart, err1 := time.Parse(CRONOFY_DATETIME_FORMAT, pb.Start)
+			bEnd, err2 := time.Parse(CRONOFY_DATETIME_FORMAT, pb.End)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+
+			start := aStart
+			if bStart.After(start) {
+				start = bStart
+			}
+			end := aEnd
+			if bEnd.Before(end) {
+				end = bEnd
+			}
+
+			if start.Before(end) {
+				result = append(result, AvailabilityPeriod{
+					Start: start.Format(CRONOFY_DATETIME_FORMAT),
+					End:   end.Format(CRONOFY_DATETIME_FORMAT),
+				})
+			}
+		}
 	}
 
-	return fmt.Sprintf(`User is available. Old status "%s", New status "%s"`, prevStatus.Status, nextStatus.Status), nil
+	return result
 }
 
 func getAvailabiltiesAndUpdateStatus(h IHandler, userID string) (string, error) {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/webhook-payload.json")
+	require.Nil(t, err)
+
+	sign := func(secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		_, _ = mac.Write(body)
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	assert.True(t, verifyWebhookSignature(body, sign("client secret"), "client secret"))
+	assert.True(t, verifyWebhookSignature(body, sign("old secret")+","+sign("client secret"), "client secret"))
+	assert.False(t, verifyWebhookSignature(body, sign("other secret"), "client secret"))
+	assert.False(t, verifyWebhookSignature(append(body, ' '), sign("client secret"), "client secret"))
+	assert.False(t, verifyWebhookSignature(body, "not base64", "client secret"))
+	assert.False(t, verifyWebhookSignature(body, sign(""), ""))
+}
+
+func TestIsWebhookChannelOwned(t *testing.T) {
+	p := newTestPlugin(newFakeAPI())
+	require.Nil(t, p.storeUserNotificationChannels("user1", map[string]NotificationChannel{"acc_1": {ChannelId: "chn_1"}}))
+
+	change := WebhookMessage{Notification: NotificationMeta{Type: "change"}, Channel: NotificationChannel{ChannelId: "chn_1"}}
+	assert.True(t, isWebhookChannelOwned(p, "user1", "acc_1", change))
+	assert.False(t, isWebhookChannelOwned(p, "user2", "acc_1", change), "replayed for another user")
+	assert.False(t, isWebhookChannelOwned(p, "user1", "acc_2", change))
+
+	verification := WebhookMessage{
+		Notification: NotificationMeta{Type: "verification"},
+		Channel:      NotificationChannel{CallbackUrl: "https://mattermost.example.com/plugins/cronofy/webhook?account_id=acc_3&user_id=user1"},
+	}
+	assert.True(t, isWebhookChannelOwned(p, "user1", "acc_3", verification))
+	assert.False(t, isWebhookChannelOwned(p, "user2", "acc_3", verification))
+}
+
+func TestGetAvailabilityOptions(t *testing.T) {
+	opts, err := (&configuration{}).getAvailabilityOptions()
+	require.Nil(t, err)
+	assert.Equal(t, &AvailabilityOptions{Lookahead: 15, RequiredDuration: 2, BufferBefore: 6, BufferAfter: 5}, opts)
+
+	_, err = (&configuration{AvailabilityLookahead: "soon"}).getAvailabilityOptions()
+	assert.NotNil(t, err)
+
+	_, err = (&configuration{AvailabilityLookahead: "10", AvailabilityRequiredDuration: "9"}).getAvailabilityOptions()
+	assert.NotNil(t, err)
+
+	lookahead := 30
+	overridden := AvailabilityOverrides{Lookahead: &lookahead}.apply(opts)
+	assert.Equal(t, 30, overridden.Lookahead)
+	assert.Equal(t, 15, opts.Lookahead)
+}
+
+func TestIsBusyAt(t *testing.T) {
+	opts := &AvailabilityOptions{BufferBefore: 5, BufferAfter: 5}
+	periods := []FreeBusyPeriod{
+		{Start: "2019-11-25T19:00:00Z", End: "2019-11-25T19:30:00Z", FreeBusyStatus: "busy"},
+		{Start: "2019-11-25T21:00:00Z", End: "2019-11-25T22:00:00Z", FreeBusyStatus: "free"},
+	}
+
+	at := func(s string) time.Time {
+		t, _ := time.Parse(CRONOFY_DATETIME_FORMAT, s)
+		return t
+	}
+
+	assert.False(t, isBusyAt(periods, opts, at("2019-11-25T18:50:00Z")))
+	assert.True(t, isBusyAt(periods, opts, at("2019-11-25T18:56:00Z")))
+	assert.True(t, isBusyAt(periods, opts, at("2019-11-25T19:34:00Z")))
+	assert.False(t, isBusyAt(periods, opts, at("2019-11-25T19:35:00Z")))
+	assert.False(t, isBusyAt(periods, opts, at("2019-11-25T21:30:00Z")))
+}
+
+func TestGetCalendarInfoDates(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	require.Nil(t, err)
+
+	for name, tc := range map[string]struct {
+		from, to time.Time
+		expected []string
+	}{
+		"within a day": {
+			from:     time.Date(2019, 11, 25, 10, 0, 0, 0, loc),
+			to:       time.Date(2019, 11, 25, 11, 0, 0, 0, loc),
+			expected: []string{"2019-11-25", "2019-11-26"},
+		},
+		"up to midnight": {
+			from:     time.Date(2019, 11, 25, 0, 0, 0, 0, loc),
+			to:       time.Date(2019, 11, 26, 0, 0, 0, 0, loc),
+			expected: []string{"2019-11-25", "2019-11-26"},
+		},
+		"taken in the location": {
+			from:     time.Date(2019, 11, 26, 3, 0, 0, 0, time.UTC),
+			to:       time.Date(2019, 11, 26, 4, 0, 0, 0, time.UTC),
+			expected: []string{"2019-11-25", "2019-11-26"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := &fakeCronofyClient{}
+			_, err := getCalendarInfo(client, []string{"cal_1"}, tc.from, tc.to, loc)
+			require.Nil(t, err)
+			require.Len(t, client.requests, 1)
+			assert.Equal(t, tc.expected, []string{*client.requests[0].From, *client.requests[0].To})
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/mattermost/mattermost-server/plugin"
+)
+
+// fakeAPI implements the parts of the plugin API used in tests, backed by memory.
+// Calling any other method panics.
+type fakeAPI struct {
+	plugin.API
+
+	config   *model.Config
+	kv       map[string][]byte
+	statuses map[string]string
+	users    map[string]*model.User
+
+	ephemeralPosts []*model.Post
+	dialogs        []model.OpenDialogRequest
+}
+
+func newFakeAPI() *fakeAPI {
+	config := &model.Config{}
+	config.SetDefaults()
+
+	return &fakeAPI{
+		config:   config,
+		kv:       map[string][]byte{},
+		statuses: map[string]string{},
+		users:    map[string]*model.User{},
+	}
+}
+
+func newTestPlugin(api *fakeAPI) *Plugin {
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.tokenManager = newTokenManager(p)
+	return p
+}
+
+func (api *fakeAPI) GetConfig() *model.Config {
+	return api.config
+}
+
+func (api *fakeAPI) KVGet(key string) ([]byte, *model.AppError) {
+	return api.kv[key], nil
+}
+
+func (api *fakeAPI) KVSet(key string, value []byte) *model.AppError {
+	api.kv[key] = value
+	return nil
+}
+
+func (api *fakeAPI) KVSetWithExpiry(key string, value []byte, expireInSeconds int64) *model.AppError {
+	api.kv[key] = value
+	return nil
+}
+
+func (api *fakeAPI) KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError) {
+	current, exists := api.kv[key]
+	if (oldValue == nil && exists) || (oldValue != nil && !bytes.Equal(current, oldValue)) {
+		return false, nil
+	}
+
+	api.kv[key] = newValue
+	return true, nil
+}
+
+func (api *fakeAPI) KVCompareAndDelete(key string, oldValue []byte) (bool, *model.AppError) {
+	current, exists := api.kv[key]
+	if !exists || !bytes.Equal(current, oldValue) {
+		return false, nil
+	}
+
+	delete(api.kv, key)
+	return true, nil
+}
+
+func (api *fakeAPI) KVDelete(key string) *model.AppError {
+	delete(api.kv, key)
+	return nil
+}
+
+func (api *fakeAPI) KVList(page, perPage int) ([]string, *model.AppError) {
+	keys := []string{}
+	for key := range api.kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	start := page * perPage
+	if start > len(keys) {
+		return []string{}, nil
+	}
+	end := start + perPage
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	return keys[start:end], nil
+}
+
+func (api *fakeAPI) GetUserStatus(userID string) (*model.Status, *model.AppError) {
+	return &model.Status{UserId: userID, Status: api.statuses[userID]}, nil
+}
+
+func (api *fakeAPI) UpdateUserStatus(userID, status string) (*model.Status, *model.AppError) {
+	api.statuses[userID] = status
+	return &model.Status{UserId: userID, Status: status}, nil
+}
+
+func (api *fakeAPI) GetUser(userID string) (*model.User, *model.AppError) {
+	user, ok := api.users[userID]
+	if !ok {
+		return nil, model.NewAppError("GetUser", "user not found", nil, "", 404)
+	}
+	return user, nil
+}
+
+func (api *fakeAPI) UpdateUser(user *model.User) (*model.User, *model.AppError) {
+	api.users[user.Id] = user
+	return user, nil
+}
+
+func (api *fakeAPI) GetUserByUsername(name string) (*model.User, *model.AppError) {
+	for _, user := range api.users {
+		if user.Username == name {
+			return user, nil
+		}
+	}
+	return nil, model.NewAppError("GetUserByUsername", "user not found", nil, "", 404)
+}
+
+func (api *fakeAPI) HasPermissionTo(userID string, permission *model.Permission) bool {
+	user, ok := api.users[userID]
+	return ok && user.IsInRole(model.SYSTEM_ADMIN_ROLE_ID)
+}
+
+func (api *fakeAPI) SendEphemeralPost(userID string, post *model.Post) *model.Post {
+	api.ephemeralPosts = append(api.ephemeralPosts, post)
+	return post
+}
+
+func (api *fakeAPI) OpenInteractiveDialog(dialog model.OpenDialogRequest) *model.AppError {
+	api.dialogs = append(api.dialogs, dialog)
+	return nil
+}
+
+func (api *fakeAPI) LogWarn(msg string, keyValuePairs ...interface{})  {}
+func (api *fakeAPI) LogError(msg string, keyValuePairs ...interface{}) {}
+func (api *fakeAPI) LogDebug(msg string, keyValuePairs ...interface{}) {}
+
+// fakeCronofyClient serves fixed calendars and events, and records the events requests it's sent.
+// Like Cronofy, it returns the events between the requested dates, excluding the to date.
+type fakeCronofyClient struct {
+	ICronofyClient
+
+	calendars    []*cronofy.Calendar
+	calendarsErr error
+	events       []*cronofy.Event
+	requests     []*cronofy.EventsRequest
+
+	// response is returned for every other request, whose payloads are recorded.
+	response []byte
+	payloads []interface{}
+}
+
+func (c *fakeCronofyClient) CronofyRequest(userID string, reqURL string, payload interface{}) (int, []byte, error) {
+	c.payloads = append(c.payloads, payload)
+	return 200, c.response, nil
+}
+
+func (c *fakeCronofyClient) GetCalendars() ([]*cronofy.Calendar, error) {
+	return c.calendars, c.calendarsErr
+}
+
+func (c *fakeCronofyClient) GetEvents(options *cronofy.EventsRequest) (*EventsResponse, error) {
+	c.requests = append(c.requests, options)
+
+	res := &EventsResponse{}
+	for _, evt := range c.events {
+		start, end, _, err := getEventTimes(evt, time.UTC)
+		if err != nil {
+			continue
+		}
+
+		if options.From != nil && end.Format(CRONOFY_DATE_FORMAT) < *options.From {
+			continue
+		}
+		if options.To != nil && start.Format(CRONOFY_DATE_FORMAT) >= *options.To {
+			continue
+		}
+
+		res.Events = append(res.Events, evt)
+	}
+
+	return res, nil
+}
+
+// fakeHandler gives the plugin a single linked account, served by the client.
+type fakeHandler struct {
+	Handler
+	client ICronofyClient
+}
+
+func newFakeHandler(p *Plugin, client ICronofyClient) *fakeHandler {
+	return &fakeHandler{Handler: Handler{plugin: p}, client: client}
+}
+
+func (h *fakeHandler) MakeCronofyClient(accessToken string) ICronofyClient {
+	return h.client
+}
+
+func (h *fakeHandler) MakeUserCronofyClients(mattermostUserID string) ([]*AccountClient, error) {
+	return []*AccountClient{{Account: &CronofyAccount{AccessTokenResponse: AccessTokenResponse{AccountId: "acc_1"}}, Client: h.client}}, nil
+}
+
+func (h *fakeHandler) MakeAccountCronofyClient(mattermostUserID string, account *CronofyAccount) ICronofyClient {
+	return h.client
+}
@@ -13,9 +13,14 @@ import (
 )
 
 const (
-	routeOAuthComplete    = "/oauth/complete"
-	routeSetParticipation = "/participation"
-	routeWebhook          = "/webhook"
+	routeOAuthComplete     = "/oauth/complete"
+	routeSetParticipation  = "/participation"
+	routeSettingsDialog    = "/settings/dialog"
+	routeCreateEventDialog = "/create/dialog"
+	routeViewEvent         = "/event"
+	routeDeleteEvent       = "/event/delete"
+	routeSchedulePick      = "/schedule/pick"
+	routeWebhook           = "/webhook"
 )
 
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
@@ -46,6 +51,16 @@ func handleHTTPRequest(p *Plugin, w http.ResponseWriter, r *http.Request) (int,
 		return httpWebhook(h, w, r)
 	case routeSetParticipation:
 		return httpSetParticipation(h, w, r)
+	case routeSettingsDialog:
+		return httpSubmitSettingsDialog(h, w, r)
+	case routeCreateEventDialog:
+		return httpSubmitCreateEventDialog(h, w, r)
+	case routeViewEvent:
+		return httpViewEvent(h, w, r)
+	case routeDeleteEvent:
+		return httpDeleteEvent(h, w, r)
+	case routeSchedulePick:
+		return httpSchedulePick(h, w, r)
 	}
 
 	return http.StatusNotFound, errors.New("not found")
@@ -2,19 +2,27 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/mattermost/mattermost-server/model"
 )
 
 const (
-	JOB_INTERVAL = 20 * time.Second // How often the job should run
+	JOB_INTERVAL   = 20 * time.Second // How often the job should run
+	JOB_BATCH_SIZE = 10               // How many users are processed concurrently
+	JOB_LOCK_TTL   = 3 * JOB_INTERVAL // How long another node waits before taking over from a lock holder that stopped renewing
 )
 
+const KVJobLock = "availability_job_lock"
+
 type RecurringJob struct {
 	cancel     chan struct{}
 	cancelled  chan struct{}
 	cancelOnce sync.Once
 	plugin     *Plugin
+	nodeID     string
 }
 
 func (p *Plugin) InitRecurringJob(enable bool) {
@@ -46,8 +54,11 @@ func (job *RecurringJob) Start() {
 		for {
 			select {
 			case <-ticker.C:
-				job.Run()
+				if job.acquireLock() {
+					job.Run()
+				}
 			case <-job.cancel:
+				job.releaseLock()
 				return
 			}
 		}
@@ -58,21 +69,145 @@ func (job *RecurringJob) Run() {
 	p := job.plugin
 	h := &Handler{plugin: p}
 
-	username := "mickmister"
-	user, appErr := p.API.GetUserByUsername(username)
-	if appErr != nil {
+	allUserIDs, err := p.listConnectedUserIDs()
+	if err != nil {
+		p.API.LogError("Failed to list users for availability job", "error", err.Error())
 		return
 	}
 
-	p.CreateBotDMtoMMUserId(user.Id, "Running availability job")
+	customStatus := p.supportsCustomStatus()
+	if !customStatus {
+		p.API.LogDebug("Skipping custom statuses for availability job", "error", errCustomStatusNotSupported.Error())
+	}
+
+	optedIn := map[string]*UserSettings{}
+	userIDs := []string{}
+	for _, userID := range allUserIDs {
+		settings, err := p.getUserSettings(userID)
+		if err != nil {
+			p.API.LogWarn("Failed to get user settings for availability job", "user_id", userID, "error", err.Error())
+			continue
+		}
+
+		if settings.StatusSync || (customStatus && settings.CustomStatus) || settings.ReminderMinutes > 0 || settings.DailyAgendaTime != "" {
+			optedIn[userID] = settings
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	lost := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go job.keepLock(done, lost)
+
+	for start := 0; start < len(userIDs); start += JOB_BATCH_SIZE {
+		end := start + JOB_BATCH_SIZE
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		wg := sync.WaitGroup{}
+		for _, userID := range userIDs[start:end] {
+			wg.Add(1)
+			go func(userID string) {
+				defer wg.Done()
+				select {
+				case <-lost:
+					return
+				default:
+				}
+				job.runForUser(h, userID, optedIn[userID], customStatus)
+			}(userID)
+		}
+		wg.Wait()
+
+		select {
+		case <-lost:
+			p.API.LogWarn("Lost the availability job lock. Stopping this cycle.", "remaining_users", len(userIDs)-end)
+			return
+		default:
+		}
+	}
+}
+
+// keepLock closes lost if the lock can't be renewed before done is closed.
+func (job *RecurringJob) keepLock(done <-chan struct{}, lost chan<- struct{}) {
+	ticker := time.NewTicker(JOB_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !job.acquireLock() {
+				close(lost)
+				return
+			}
+		}
+	}
+}
+
+// runForUser runs each step independently, so one failing doesn't hold back the others.
+func (job *RecurringJob) runForUser(h IHandler, userID string, settings *UserSettings, customStatus bool) {
+	p := job.plugin
+	result := &JobResult{RanAt: time.Now()}
+
+	steps := []struct {
+		name    string
+		enabled bool
+		run     func() (string, error)
+	}{
+		{"status", settings.StatusSync, func() (string, error) { return getAvailabiltiesAndUpdateStatus(h, userID) }},
+		{"custom status", customStatus && settings.CustomStatus, func() (string, error) { return updateUserCustomStatus(h, userID, settings) }},
+		{"reminders", settings.ReminderMinutes > 0, func() (string, error) { return sendDueReminders(h, userID, settings) }},
+		{"agenda", settings.DailyAgendaTime != "", func() (string, error) { return sendDailyAgenda(h, userID, settings) }},
+	}
+
+	results := []string{}
+	errs := []string{}
+	for _, step := range steps {
+		if !step.enabled {
+			continue
+		}
+
+		res, err := runJobStep(step.run)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", step.name, err.Error()))
+			continue
+		}
+		results = append(results, res)
+	}
+
+	result.Result = strings.Join(results, " ")
+	result.Error = strings.Join(errs, "; ")
 
-	res, err := getAvailabiltiesAndUpdateStatus(h, user.Id)
+	if result.Error != "" {
+		p.API.LogWarn("Availability job failed for user", "user_id", userID, "error", result.Error)
+	}
+
+	err := p.storeJobResult(userID, result)
 	if err != nil {
-		p.CreateBotDMtoMMUserId(user.Id, fmt.Sprintf("Failed to run availability job. %s", err.Error()))
-		return
+		p.API.LogWarn("Failed to store availability job result", "user_id", userID, "error", err.Error())
 	}
+}
+
+func runJobStep(run func() (string, error)) (res string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return run()
+}
+
+func (job *RecurringJob) acquireLock() bool {
+	return job.plugin.acquireClusterLock(KVJobLock, job.nodeID, JOB_LOCK_TTL)
+}
 
-	p.CreateBotDMtoMMUserId(user.Id, fmt.Sprintf("Successfully ran availability job. %s", res))
+func (job *RecurringJob) releaseLock() {
+	job.plugin.releaseClusterLock(KVJobLock, job.nodeID)
 }
 
 func newRecurringJob(p *Plugin) *RecurringJob {
@@ -80,6 +215,7 @@ func newRecurringJob(p *Plugin) *RecurringJob {
 		cancel:    make(chan struct{}),
 		cancelled: make(chan struct{}),
 		plugin:    p,
+		nodeID:    model.NewId(),
 	}
 }
 
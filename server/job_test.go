@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunForUser(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api)
+	job := newRecurringJob(p)
+
+	// The fake client can't return availability, so the status step fails.
+	client := &fakeCronofyClient{calendars: []*cronofy.Calendar{{CalendarID: "cal_1"}}}
+	h := newFakeHandler(p, client)
+
+	job.runForUser(h, "user1", &UserSettings{StatusSync: true, ReminderMinutes: 10}, false)
+
+	result := &JobResult{}
+	require.Nil(t, json.Unmarshal(api.kv[KVJobResultPrefix+"user1"], result))
+	assert.Contains(t, result.Error, "status: ")
+	assert.Equal(t, "Sent 0 reminder(s).", result.Result)
+	assert.NotNil(t, api.kv[KVReminderSchedulePrefix+"user1"])
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ClusterLock is held in the KV store by the node doing work only one node may do.
+type ClusterLock struct {
+	NodeID    string `json:"node_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// acquireClusterLock takes or renews the lock. An expired lock can be taken by any node.
+func (p *Plugin) acquireClusterLock(key, nodeID string, ttl time.Duration) bool {
+	current, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		p.API.LogError("Failed to get cluster lock", "key", key, "error", appErr.Error())
+		return false
+	}
+
+	now := time.Now()
+	if current != nil {
+		lock := &ClusterLock{}
+		err := json.Unmarshal(current, lock)
+		if err == nil && lock.NodeID != nodeID && now.Before(time.Unix(0, lock.ExpiresAt)) {
+			return false
+		}
+	}
+
+	next, err := json.Marshal(&ClusterLock{
+		NodeID:    nodeID,
+		ExpiresAt: now.Add(ttl).UnixNano(),
+	})
+	if err != nil {
+		return false
+	}
+
+	acquired, appErr := p.API.KVCompareAndSet(key, current, next)
+	if appErr != nil {
+		p.API.LogError("Failed to set cluster lock", "key", key, "error", appErr.Error())
+		return false
+	}
+
+	return acquired
+}
+
+func (p *Plugin) releaseClusterLock(key, nodeID string) {
+	current, appErr := p.API.KVGet(key)
+	if appErr != nil || current == nil {
+		return
+	}
+
+	lock := &ClusterLock{}
+	err := json.Unmarshal(current, lock)
+	if err != nil || lock.NodeID != nodeID {
+		return
+	}
+
+	_, _ = p.API.KVCompareAndDelete(key, current)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterLock(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api)
+
+	assert.True(t, p.acquireClusterLock("lock", "node1", time.Minute))
+	assert.False(t, p.acquireClusterLock("lock", "node2", time.Minute), "held by another node")
+	assert.True(t, p.acquireClusterLock("lock", "node1", time.Minute), "renewed by the holder")
+
+	p.releaseClusterLock("lock", "node2")
+	assert.False(t, p.acquireClusterLock("lock", "node2", time.Minute), "only the holder can release it")
+
+	p.releaseClusterLock("lock", "node1")
+	assert.True(t, p.acquireClusterLock("lock", "node2", -time.Minute), "released")
+	assert.True(t, p.acquireClusterLock("lock", "node1", time.Minute), "expired")
+}
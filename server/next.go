@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+)
+
+const nextEventLookahead = 7 * 24 * time.Hour
+
+// nextEventGracePeriod keeps showing an event after it starts, for joining late.
+const nextEventGracePeriod = 10 * time.Minute
+
+const maxNextEventAttendees = 10
+
+var conferenceLinkPatterns = []struct {
+	Provider string
+	Pattern  *regexp.Regexp
+}{
+	{"Zoom", regexp.MustCompile(`https://[\w.-]*zoom\.us/(j|my|w)/[^\s"'<>)\]]+`)},
+	{"Google Meet", regexp.MustCompile(`https://meet\.google\.com/[a-z0-9-]+`)},
+	{"Microsoft Teams", regexp.MustCompile(`https://teams\.microsoft\.com/l/meetup-join/[^\s"'<>)\]]+`)},
+}
+
+func findNextEvent(events []*cronofy.Event, now time.Time) *cronofy.Event {
+	var next *cronofy.Event
+	var nextStart time.Time
+	for _, evt := range events {
+		if evt.Declined() || isEventRemoved(evt) {
+			continue
+		}
+
+		start, _, allDay, err := getEventTimes(evt, now.Location())
+		if err != nil || allDay || start.Before(now.Add(-nextEventGracePeriod)) {
+			continue
+		}
+
+		if next == nil || start.Before(nextStart) {
+			next = evt
+			nextStart = start
+		}
+	}
+
+	return next
+}
+
+// getJoinLink falls back to a link in the location or description when Cronofy has no details.
+func getJoinLink(evt *cronofy.Event, conferencing *Conferencing) (provider, link string) {
+	if conferencing != nil && conferencing.JoinURL != "" {
+		return conferencing.ProviderDescription, conferencing.JoinURL
+	}
+
+	for _, text := range []string{evt.Loc.Description, evt.Description} {
+		for _, p := range conferenceLinkPatterns {
+			link = p.Pattern.FindString(text)
+			if link != "" {
+				return p.Provider, link
+			}
+		}
+	}
+
+	return "", ""
+}
+
+func formatJoinLink(evt *cronofy.Event, conferencing *Conferencing) string {
+	provider, link := getJoinLink(evt, conferencing)
+	if link == "" {
+		return ""
+	}
+
+	if provider == "" {
+		provider = "the meeting"
+	}
+
+	return fmt.Sprintf("[Join %s](%s)", provider, link)
+}
+
+func formatRelativeTime(t, now time.Time) string {
+	d := t.Sub(now).Round(time.Minute)
+
+	switch {
+	case d < 0:
+		return fmt.Sprintf("started %s ago", formatDuration(-d))
+	case d == 0:
+		return "now"
+	case d < 24*time.Hour && startOfDay(t).Equal(startOfDay(now)):
+		return fmt.Sprintf("in %s", formatDuration(d))
+	case startOfDay(t).Equal(startOfDay(now).AddDate(0, 0, 1)):
+		return fmt.Sprintf("tomorrow at %s", t.Format(DEFAULT_TIME_FORMAT))
+	}
+
+	return fmt.Sprintf("on %s", t.Format(DEFAULT_DATETIME_FORMAT))
+}
+
+func formatDuration(d time.Duration) string {
+	hours := int(d.Hours())
+	minutes := int(d.Minutes()) % 60
+
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+
+	switch {
+	case hours == 0:
+		return plural(minutes, "minute")
+	case minutes == 0:
+		return plural(hours, "hour")
+	}
+
+	return plural(hours, "hour") + " " + plural(minutes, "minute")
+}
+
+func formatAttendees(evt *cronofy.Event) string {
+	names := []string{}
+	for i, a := range evt.Attendees {
+		if i == maxNextEventAttendees {
+			names = append(names, fmt.Sprintf("and %d more", len(evt.Attendees)-maxNextEventAttendees))
+			break
+		}
+		names = append(names, formatPerson(a.DisplayName, a.Email))
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func formatNextEvent(evt *cronofy.Event, conferencing *Conferencing, now time.Time) string {
+	start, _, _, _ := getEventTimes(evt, now.Location())
+
+	summary := evt.Summary
+	if summary == "" {
+		summary = "(No title)"
+	}
+
+	rows := []string{
+		fmt.Sprintf("#### Next: \"%s\"", summary),
+		fmt.Sprintf("* **When:** %s, %s", formatRelativeTime(start, now), formatEventTimeRange(evt, now.Location())),
+	}
+
+	if location := evt.Location(); location != "" {
+		rows = append(rows, fmt.Sprintf("* **Location:** %s", location))
+	}
+
+	if len(evt.Attendees) > 0 {
+		rows = append(rows, fmt.Sprintf("* **Attendees:** %s", formatAttendees(evt)))
+	}
+
+	if evt.ParticipationStatus == "needs_action" {
+		rows = append(rows, "* You haven't replied to this invite yet.")
+	}
+
+	if link := formatJoinLink(evt, conferencing); link != "" {
+		rows = append(rows, fmt.Sprintf("* **Join:** %s", link))
+	}
+
+	return strings.Join(rows, "\n")
+}
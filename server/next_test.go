@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindNextEvent(t *testing.T) {
+	now := time.Date(2019, 11, 25, 10, 0, 0, 0, time.UTC)
+
+	holiday := &cronofy.Event{Summary: "Holiday", Start: "2019-11-25", End: "2019-11-26"}
+	earlier := &cronofy.Event{Summary: "Earlier", Start: "2019-11-25T09:00:00Z", End: "2019-11-25T09:30:00Z"}
+	late := &cronofy.Event{Summary: "Late", Start: "2019-11-25T09:55:00Z", End: "2019-11-25T10:30:00Z"}
+	declined := &cronofy.Event{Summary: "Declined", Start: "2019-11-25T09:58:00Z", End: "2019-11-25T10:30:00Z", ParticipationStatus: "declined"}
+	later := &cronofy.Event{Summary: "Later", Start: "2019-11-25T14:00:00Z", End: "2019-11-25T15:00:00Z"}
+
+	assert.Equal(t, late, findNextEvent([]*cronofy.Event{later, holiday, earlier, declined, late}, now))
+	assert.Equal(t, later, findNextEvent([]*cronofy.Event{later, earlier}, now))
+	assert.Nil(t, findNextEvent([]*cronofy.Event{holiday, earlier}, now))
+
+	assert.Equal(t, "started 5 minutes ago", formatRelativeTime(now.Add(-5*time.Minute), now))
+	assert.Equal(t, "in 4 hours", formatRelativeTime(now.Add(4*time.Hour), now))
+	assert.Equal(t, "tomorrow at 9:00 AM", formatRelativeTime(now.Add(23*time.Hour), now))
+
+	untitled := &cronofy.Event{Start: "2019-11-25T14:00:00Z", End: "2019-11-25T15:00:00Z"}
+	assert.Contains(t, formatNextEvent(untitled, nil, now), `#### Next: "(No title)"`)
+}
+
+func TestGetJoinLink(t *testing.T) {
+	evt := &cronofy.Event{Description: "Join: https://acme.zoom.us/j/123456789?pwd=abc\nOr dial in"}
+	provider, link := getJoinLink(evt, nil)
+	assert.Equal(t, "Zoom", provider)
+	assert.Equal(t, "https://acme.zoom.us/j/123456789?pwd=abc", link)
+
+	evt.Loc.Description = "https://meet.google.com/abc-defg-hij"
+	provider, link = getJoinLink(evt, nil)
+	assert.Equal(t, "Google Meet", provider)
+	assert.Equal(t, "https://meet.google.com/abc-defg-hij", link)
+
+	provider, link = getJoinLink(evt, &Conferencing{ProviderDescription: "Microsoft Teams", JoinURL: "https://teams.microsoft.com/l/meetup-join/19%3ameeting"})
+	assert.Equal(t, "Microsoft Teams", provider)
+	assert.Equal(t, "https://teams.microsoft.com/l/meetup-join/19%3ameeting", link)
+
+	_, link = getJoinLink(&cronofy.Event{Description: "Room 4"}, nil)
+	assert.Empty(t, link)
+}
@@ -20,6 +20,19 @@ type AccessTokenRequest struct {
 	RedirectUri  string `json:"redirect_uri"`
 }
 
+type RefreshTokenRequest struct {
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	GrantType    string `json:"grant_type"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RevokeTokenRequest struct {
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
+}
+
 type AccessTokenResponse struct {
 	// "access_token": "P531x88i05Ld2yXHIQ7WjiEyqlmOHsgI",
 	AccessToken string `json:"access_token"`
@@ -42,11 +55,10 @@ type AccessTokenResponse struct {
 	// "expires_in": 3600,
 	ExpiresIn int `json:"expires_in"`
 
-	LinkingProfile struct {
-		ProviderName string `json:"provider_name"`
-		ProfileId    string `json:"profile_id"`
-		ProfileName  string `json:"profile_name"`
-	} `json:"linking_profile"`
+	// ExpiresAt is computed from ExpiresIn when the token is received.
+	ExpiresAt time.Time `json:"expires_at"`
+
+	LinkingProfile LinkingProfile `json:"linking_profile"`
 
 	// "linking_profile": {
 	//   "provider_name": "google",
@@ -58,40 +70,60 @@ type AccessTokenResponse struct {
 func httpOAuthComplete(h IHandler, w http.ResponseWriter, r *http.Request) (status int, err error) {
 	p := h.GetPlugin()
 
+	parts := strings.Split(r.URL.Query().Get("state"), "||")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return http.StatusBadRequest, errors.New("missing or malformed state for OAuth Connect")
+	}
+	mattermostUserID := parts[0]
+	providedState := parts[1]
+
+	if r.Header.Get("Mattermost-User-Id") != mattermostUserID {
+		return http.StatusUnauthorized, errors.New("OAuth Connect must be completed by the user who started it")
+	}
+
+	valid, err := p.consumeOAuthUserState(mattermostUserID, []byte(providedState))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !valid {
+		return http.StatusBadRequest, errors.New("OAuth state is invalid, expired or has already been used. Please run `/cronofy connect` again")
+	}
+
 	code := r.URL.Query().Get("code")
+	if code == "" {
+		return http.StatusBadRequest, errors.New("missing authorization code for OAuth Connect")
+	}
+
 	res, err := getAccessToken(p, code)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
-	parts := strings.Split(r.URL.Query().Get("state"), "||")
-	mattermostUserID := parts[0]
-	providedState := parts[1]
+	res.setExpiry(time.Now())
 
-	storedState, _ := p.getOAuthUserState(mattermostUserID)
-	if string(storedState) != providedState {
-		w.Write([]byte(fmt.Sprintf(`state does not match "%s" "%s"`, providedState, storedState)))
-		return http.StatusBadRequest, errors.New("Cronofy supplied incorrect state for OAuth Connect")
+	cronofyUser, err := p.getCronofyUser(mattermostUserID)
+	if err == errNotConnected {
+		cronofyUser, err = &CronofyUser{}, nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
 	}
 
-	p.storeCronofyUser(mattermostUserID, res)
+	cronofyUser.addAccount(res)
+
+	err = p.storeCronofyUser(mattermostUserID, cronofyUser)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
 
 	provider := res.LinkingProfile.ProviderName
 	email := res.LinkingProfile.ProfileName
-
-	providerPretty := provider
-	switch provider {
-	case "google":
-		providerPretty = "Google"
-	case "live_connect":
-		providerPretty = "Outlook"
-	}
+	providerPretty := prettyProviderName(provider)
 
 	go func() {
-		s, err := createNotificationChannel(h, mattermostUserID)
-		if err == nil {
-			data := []byte(s)
-			p.API.KVSet("cronofy_notification_channel", data)
+		err := syncUserNotificationChannels(h, mattermostUserID)
+		if err != nil {
+			p.API.LogWarn("Failed to sync notification channels after connect", "user_id", mattermostUserID, "error", err.Error())
 		}
 	}()
 
@@ -113,11 +145,78 @@ func newAccessTokenRequest(p *Plugin, code string) AccessTokenRequest {
 	}
 }
 
+func newRefreshTokenRequest(p *Plugin, refreshToken string) RefreshTokenRequest {
+	return RefreshTokenRequest{
+		ClientId:     p.getConfiguration().ClientID,
+		ClientSecret: p.getConfiguration().ClientSecret,
+		GrantType:    "refresh_token",
+		RefreshToken: refreshToken,
+	}
+}
+
+func (res *AccessTokenResponse) setExpiry(issuedAt time.Time) {
+	res.ExpiresAt = issuedAt.Add(time.Duration(res.ExpiresIn) * time.Second)
+}
+
 func getAccessToken(p *Plugin, code string) (*AccessTokenResponse, error) {
 	payload := newAccessTokenRequest(p, code)
+	return requestOAuthToken(payload)
+}
+
+func refreshAccessToken(p *Plugin, refreshToken string) (*AccessTokenResponse, error) {
+	payload := newRefreshTokenRequest(p, refreshToken)
+	return requestOAuthToken(payload)
+}
+
+func revokeToken(p *Plugin, token string) error {
+	payload := RevokeTokenRequest{
+		ClientId:     p.getConfiguration().ClientID,
+		ClientSecret: p.getConfiguration().ClientSecret,
+		Token:        token,
+	}
+
+	status, body, err := oauthRequest("https://api.cronofy.com/oauth/token/revoke", payload)
+	if err != nil {
+		return err
+	}
+
+	if status >= 300 {
+		return fmt.Errorf("Cronofy returned status %d %s", status, string(body))
+	}
+
+	return nil
+}
+
+func requestOAuthToken(payload interface{}) (*AccessTokenResponse, error) {
+	status, body, err := oauthRequest("https://api.cronofy.com/oauth/token", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if status >= 300 {
+		var oauthErr struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(body, &oauthErr)
+		if oauthErr.Error == "invalid_grant" {
+			return nil, errInvalidGrant
+		}
+		return nil, fmt.Errorf("Cronofy returned status %d %s", status, string(body))
+	}
+
+	var result AccessTokenResponse
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, errors.Wrap(err, "new request failed 5")
+	}
+
+	return &result, nil
+}
+
+func oauthRequest(reqURL string, payload interface{}) (int, []byte, error) {
 	jsonPayload, err := json.Marshal(&payload)
 	if err != nil {
-		return nil, errors.Wrap(err, "new request failed 1")
+		return 0, nil, errors.Wrap(err, "new request failed 1")
 	}
 
 	timeout := time.Duration(5 * time.Second)
@@ -125,31 +224,24 @@ func getAccessToken(p *Plugin, code string) (*AccessTokenResponse, error) {
 		Timeout: timeout,
 	}
 
-	reqURL := "https://api.cronofy.com/oauth/token"
 	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(jsonPayload))
 	if err != nil {
-		return nil, errors.Wrap(err, "new request failed 2")
+		return 0, nil, errors.Wrap(err, "new request failed 2")
 	}
 
 	req.Header.Add("Content-Type", "application/json; charset=utf-8")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "new request failed 3")
+		return 0, nil, errors.Wrap(err, "new request failed 3")
 	}
 
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, errors.Wrap(err, "new request failed 4")
-	}
-
-	var result AccessTokenResponse
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		return nil, errors.Wrap(err, "new request failed 5")
+		return 0, nil, errors.Wrap(err, "new request failed 4")
 	}
 
-	return &result, nil
+	return resp.StatusCode, body, nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+var participationStatuses = []struct {
+	Name   string
+	Status string
+}{
+	{"Accept", "accepted"},
+	{"Decline", "declined"},
+	{"Tentative", "tentative"},
+}
+
+// getParticipationAttachment keeps its buttons after a reply, so the reply can be changed.
+func getParticipationAttachment(evt *cronofy.Event) *model.SlackAttachment {
+	actions := []*model.PostAction{}
+	for _, ps := range participationStatuses {
+		actions = append(actions, getParticipationAction(evt, ps.Name, ps.Status))
+	}
+
+	return &model.SlackAttachment{
+		Text:    fmt.Sprintf(`%s has invited you for "%s"`, evt.Organizer.Email, evt.Summary),
+		Actions: actions,
+	}
+}
+
+func getParticipationAction(evt *cronofy.Event, name, participation string) *model.PostAction {
+	return &model.PostAction{
+		Type: model.POST_ACTION_TYPE_BUTTON,
+		Name: name,
+		Integration: &model.PostActionIntegration{
+			URL: "/plugins/cronofy" + routeSetParticipation,
+			Context: map[string]interface{}{
+				"calendar_id":   evt.CalendarID,
+				"event_uid":     evt.EventUID,
+				"participation": participation,
+			},
+		},
+	}
+}
+
+func httpSetParticipation(h IHandler, w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := r.Header.Get("Mattermost-User-Id")
+	if mattermostUserID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	p := h.GetPlugin()
+
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != mattermostUserID {
+		return http.StatusBadRequest, errors.New("invalid post action request")
+	}
+
+	participation, _ := request.Context["participation"].(string)
+	cid, _ := request.Context["calendar_id"].(string)
+	eid, _ := request.Context["event_uid"].(string)
+	if participation == "" || cid == "" || eid == "" {
+		return http.StatusBadRequest, errors.New("missing event in post action context")
+	}
+
+	body := map[string]string{
+		"status": participation,
+	}
+
+	response := &model.PostActionIntegrationResponse{}
+
+	client, err := getCalendarClient(h, mattermostUserID, cid)
+	if err != nil {
+		response.EphemeralText = fmt.Sprintf("Failed to change event's status: %s", err.Error())
+		return writePostActionResponse(w, response)
+	}
+
+	reqURL := fmt.Sprintf("https://api.cronofy.com/v1/calendars/%s/events/%s/participation_status", url.PathEscape(cid), url.PathEscape(eid))
+	status, _, err := client.CronofyRequest(mattermostUserID, reqURL, body)
+	if err != nil || status != http.StatusAccepted {
+		response.EphemeralText = "Failed to change event's status."
+		return writePostActionResponse(w, response)
+	}
+
+	text := fmt.Sprintf(`You have replied: %s`, strings.Title(participation))
+	evt, err := p.getEvent(mattermostUserID, eid)
+	if err == nil && evt != nil {
+		when := formatEventTimeRange(evt, p.getUserLocation(mattermostUserID))
+		text = fmt.Sprintf(`You have replied %s to "%s" with %s for %s`, strings.Title(participation), evt.Summary, evt.Organizer.Email, when)
+	}
+
+	post, appErr := p.API.GetPost(request.PostId)
+	if appErr != nil {
+		response.EphemeralText = text
+		return writePostActionResponse(w, response)
+	}
+
+	updateParticipationAttachment(post, eid, text)
+	response.Update = post
+
+	return writePostActionResponse(w, response)
+}
+
+func updateParticipationAttachment(post *model.Post, eventUID, text string) {
+	attachments := post.Attachments()
+	for _, attachment := range attachments {
+		for _, action := range attachment.Actions {
+			if action.Integration == nil || action.Integration.Context["event_uid"] != eventUID {
+				continue
+			}
+
+			attachment.Fields = []*model.SlackAttachmentField{{
+				Title: "Your reply",
+				Value: text,
+			}}
+			break
+		}
+	}
+
+	model.ParseSlackAttachment(post, attachments)
+}
+
+func writePostActionResponse(w http.ResponseWriter, response *model.PostActionIntegrationResponse) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
@@ -27,14 +27,22 @@ func (p *Plugin) OnActivate() error {
 	}
 
 	p.botUserID = botUserID
+	p.tokenManager = newTokenManager(p)
 
 	err = p.API.RegisterCommand(getCommand())
 	if err != nil {
 		return errors.WithMessage(err, "OnActivate: failed to register command")
 	}
 
+	err = p.deleteLegacyData()
+	if err != nil {
+		p.API.LogWarn("Failed to delete legacy data", "error", err.Error())
+	}
+
 	p.InitRecurringJob(p.getConfiguration().EnableAvailabilityJob)
 
+	p.checkNotificationChannels()
+
 	return nil
 }
 
@@ -51,6 +59,8 @@ type Plugin struct {
 
 	botUserID string
 
+	tokenManager *TokenManager
+
 	recurringJob *RecurringJob
 }
 
@@ -65,6 +75,8 @@ func (p *Plugin) getSiteURL() string {
 type IHandler interface {
 	GetPlugin() *Plugin
 	MakeCronofyClient(accessToken string) ICronofyClient
+	MakeUserCronofyClients(mattermostUserID string) ([]*AccountClient, error)
+	MakeAccountCronofyClient(mattermostUserID string, account *CronofyAccount) ICronofyClient
 }
 
 type Handler struct {
@@ -78,3 +90,40 @@ func (h *Handler) GetPlugin() *Plugin {
 func (h *Handler) MakeCronofyClient(accessToken string) ICronofyClient {
 	return NewCronofyClient(accessToken)
 }
+
+type AccountClient struct {
+	Account *CronofyAccount
+	Client  ICronofyClient
+}
+
+func (h *Handler) MakeUserCronofyClients(mattermostUserID string) ([]*AccountClient, error) {
+	cronofyUser, err := h.plugin.tokenManager.GetCronofyUser(mattermostUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := []*AccountClient{}
+	for _, account := range cronofyUser.Accounts {
+		clients = append(clients, &AccountClient{
+			Account: account,
+			Client:  h.MakeAccountCronofyClient(mattermostUserID, account),
+		})
+	}
+
+	return clients, nil
+}
+
+func (h *Handler) MakeAccountCronofyClient(mattermostUserID string, account *CronofyAccount) ICronofyClient {
+	tm := h.plugin.tokenManager
+	accountID := account.AccountId
+
+	refresh := func(rejectedToken string) (string, error) {
+		res, err := tm.Refresh(mattermostUserID, accountID, rejectedToken)
+		if err != nil {
+			return "", err
+		}
+		return res.AccessToken, nil
+	}
+
+	return NewRefreshingCronofyClient(account.AccessToken, refresh)
+}
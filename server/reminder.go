@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+)
+
+// reminderRefreshInterval is how often upcoming events are reread between webhooks.
+const reminderRefreshInterval = 15 * time.Minute
+
+const reminderStoreAttempts = 3
+
+// ReminderSchedule caches a user's upcoming events for reminders and custom status.
+type ReminderSchedule struct {
+	RefreshedAt  time.Time                `json:"refreshed_at"`
+	Until        time.Time                `json:"until"`
+	Events       []*cronofy.Event         `json:"events"`
+	Conferencing map[string]*Conferencing `json:"conferencing"`
+
+	// Sent holds the reminded start of each event, so a moved event is reminded again.
+	Sent map[string]string `json:"sent"`
+}
+
+func newReminderSchedule() *ReminderSchedule {
+	return &ReminderSchedule{
+		Conferencing: map[string]*Conferencing{},
+		Sent:         map[string]string{},
+	}
+}
+
+func (s *ReminderSchedule) needsRefresh(lead time.Duration, now time.Time) bool {
+	return now.Sub(s.RefreshedAt) >= reminderRefreshInterval || now.Add(lead).After(s.Until)
+}
+
+func (s *ReminderSchedule) refresh(res *UserEvents, until, now time.Time) {
+	s.RefreshedAt = now
+	s.Until = until
+	s.Events = res.Events
+	s.Conferencing = res.Conferencing
+
+	current := map[string]bool{}
+	for _, evt := range s.Events {
+		current[evt.EventUID] = true
+	}
+
+	for uid := range s.Sent {
+		if !current[uid] {
+			delete(s.Sent, uid)
+		}
+	}
+}
+
+func (s *ReminderSchedule) refreshIfNeeded(h IHandler, userID string, lead time.Duration, now time.Time) ([]string, bool, error) {
+	if !s.needsRefresh(lead, now) {
+		return nil, false, nil
+	}
+
+	until := now.Add(lead + reminderRefreshInterval)
+	res, err := getUserEvents(h, userID, now, until)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.refresh(res, until, now)
+	return res.Errors, true, nil
+}
+
+func (s *ReminderSchedule) applyChanges(changed []*cronofy.Event, conferencing map[string]*Conferencing) {
+	byUID := map[string]*cronofy.Event{}
+	for _, evt := range changed {
+		byUID[evt.EventUID] = evt
+	}
+
+	events := []*cronofy.Event{}
+	for _, evt := range s.Events {
+		if byUID[evt.EventUID] == nil {
+			events = append(events, evt)
+		}
+	}
+
+	for _, evt := range changed {
+		delete(s.Conferencing, evt.EventUID)
+
+		if isEventRemoved(evt) {
+			delete(s.Sent, evt.EventUID)
+			continue
+		}
+
+		events = append(events, evt)
+		if conferencing[evt.EventUID] != nil {
+			s.Conferencing[evt.EventUID] = conferencing[evt.EventUID]
+		}
+	}
+
+	s.Events = events
+}
+
+func (s *ReminderSchedule) dueReminders(lead time.Duration, now time.Time) []*cronofy.Event {
+	due := []*cronofy.Event{}
+	for _, evt := range s.Events {
+		if evt.ParticipationStatus != "accepted" && evt.ParticipationStatus != "tentative" {
+			continue
+		}
+
+		if isEventRemoved(evt) || s.Sent[evt.EventUID] == evt.Start {
+			continue
+		}
+
+		start, _, allDay, err := getEventTimes(evt, now.Location())
+		if err != nil || allDay {
+			continue
+		}
+
+		if start.After(now) && !start.After(now.Add(lead)) {
+			due = append(due, evt)
+		}
+	}
+
+	return due
+}
+
+func sendDueReminders(h IHandler, userID string, settings *UserSettings) (string, error) {
+	p := h.GetPlugin()
+
+	lead := time.Duration(settings.ReminderMinutes) * time.Minute
+	now := time.Now().In(p.getUserLocation(userID))
+
+	stored, schedule, err := p.getReminderSchedule(userID)
+	if err != nil {
+		return "", err
+	}
+
+	results, changed, err := schedule.refreshIfNeeded(h, userID, lead, now)
+	if err != nil {
+		return "", err
+	}
+
+	due := schedule.dueReminders(lead, now)
+	for _, evt := range due {
+		schedule.Sent[evt.EventUID] = evt.Start
+		changed = true
+	}
+
+	if !changed {
+		return "No reminders due.", nil
+	}
+
+	// Claim the reminders first so another node can't send them too.
+	saved, err := p.compareAndStoreReminderSchedule(userID, stored, schedule)
+	if err != nil {
+		return "", err
+	}
+
+	if !saved {
+		return "Reminder schedule changed concurrently.", nil
+	}
+
+	for _, evt := range due {
+		_, err = p.CreateBotDMtoMMUserId(userID, "%s", formatReminder(evt, schedule.Conferencing[evt.EventUID], now))
+		if err != nil {
+			results = append(results, err.Error())
+		}
+	}
+
+	results = append(results, fmt.Sprintf("Sent %d reminder(s).", len(due)))
+	return strings.Join(results, " "), nil
+}
+
+func rescheduleReminders(h IHandler, userID string, settings *UserSettings, events []*cronofy.Event, conferencing map[string]*Conferencing) error {
+	p := h.GetPlugin()
+
+	included := []*cronofy.Event{}
+	for _, evt := range events {
+		if settings.includesCalendar(evt.CalendarID) {
+			included = append(included, evt)
+		}
+	}
+
+	for i := 0; i < reminderStoreAttempts; i++ {
+		stored, schedule, err := p.getReminderSchedule(userID)
+		if err != nil {
+			return err
+		}
+
+		if stored == nil {
+			return nil
+		}
+
+		schedule.applyChanges(included, conferencing)
+
+		saved, err := p.compareAndStoreReminderSchedule(userID, stored, schedule)
+		if err != nil || saved {
+			return err
+		}
+	}
+
+	return fmt.Errorf("Reminder schedule was changed concurrently %d times", reminderStoreAttempts)
+}
+
+func formatReminder(evt *cronofy.Event, conferencing *Conferencing, now time.Time) string {
+	start, _, _, _ := getEventTimes(evt, now.Location())
+
+	rows := []string{
+		fmt.Sprintf("#### Reminder: \"%s\" starts %s", evt.Summary, formatRelativeTime(start, now)),
+		fmt.Sprintf("* **When:** %s", formatEventTimeRange(evt, now.Location())),
+	}
+
+	if location := evt.Location(); location != "" {
+		rows = append(rows, fmt.Sprintf("* **Location:** %s", location))
+	}
+
+	if link := formatJoinLink(evt, conferencing); link != "" {
+		rows = append(rows, fmt.Sprintf("* **Join:** %s", link))
+	}
+
+	return strings.Join(rows, "\n")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReminderSchedule(t *testing.T) {
+	now := time.Date(2019, 11, 25, 10, 0, 0, 0, time.UTC)
+	lead := 10 * time.Minute
+
+	standup := &cronofy.Event{EventUID: "standup", Start: "2019-11-25T10:05:00Z", End: "2019-11-25T10:15:00Z", ParticipationStatus: "accepted"}
+	review := &cronofy.Event{EventUID: "review", Start: "2019-11-25T10:08:00Z", End: "2019-11-25T11:00:00Z", ParticipationStatus: "tentative"}
+	invite := &cronofy.Event{EventUID: "invite", Start: "2019-11-25T10:05:00Z", End: "2019-11-25T10:30:00Z", ParticipationStatus: "needs_action"}
+	lunch := &cronofy.Event{EventUID: "lunch", Start: "2019-11-25T12:00:00Z", End: "2019-11-25T13:00:00Z", ParticipationStatus: "accepted"}
+
+	schedule := newReminderSchedule()
+	schedule.refresh(&UserEvents{Events: []*cronofy.Event{standup, review, invite, lunch}, Conferencing: map[string]*Conferencing{}}, now.Add(lead+reminderRefreshInterval), now)
+	assert.False(t, schedule.needsRefresh(lead, now))
+	assert.True(t, schedule.needsRefresh(lead, now.Add(reminderRefreshInterval)))
+
+	assert.Equal(t, []*cronofy.Event{standup, review}, schedule.dueReminders(lead, now))
+
+	schedule.Sent[standup.EventUID] = standup.Start
+	schedule.Sent[review.EventUID] = review.Start
+	assert.Empty(t, schedule.dueReminders(lead, now))
+
+	// A moved event is reminded of again, and a cancelled one is dropped.
+	moved := *standup
+	moved.Start = "2019-11-25T10:07:00Z"
+	cancelled := *review
+	cancelled.Deleted = true
+	schedule.applyChanges([]*cronofy.Event{&moved, &cancelled}, map[string]*Conferencing{})
+	assert.Equal(t, []*cronofy.Event{&moved}, schedule.dueReminders(lead, now))
+	assert.NotContains(t, schedule.Sent, review.EventUID)
+
+	// Only one node can claim a reminder.
+	p := newTestPlugin(newFakeAPI())
+	stored, schedule, err := p.getReminderSchedule("user1")
+	require.Nil(t, err)
+	assert.Nil(t, stored)
+
+	saved, err := p.compareAndStoreReminderSchedule("user1", stored, schedule)
+	require.Nil(t, err)
+	assert.True(t, saved)
+
+	saved, err = p.compareAndStoreReminderSchedule("user1", stored, schedule)
+	require.Nil(t, err)
+	assert.False(t, saved)
+}
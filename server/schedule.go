@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const scheduleUsage = "Please run `/cronofy schedule @user [@user...] <duration> [within today|tomorrow|week|next week|YYYY-MM-DD [YYYY-MM-DD]]`"
+
+const (
+	maxScheduleDays = 35
+
+	maxScheduleSlots = 5
+
+	// Working hours in the organizer's timezone.
+	scheduleDayStart = 9
+	scheduleDayEnd   = 17
+)
+
+type ScheduleQuery struct {
+	Usernames []string
+	Duration  time.Duration
+	From      time.Time
+	To        time.Time
+}
+
+func parseScheduleQuery(args []string, now time.Time) (*ScheduleQuery, error) {
+	query := &ScheduleQuery{}
+
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "@"); i++ {
+		username := strings.TrimSuffix(strings.TrimPrefix(args[i], "@"), ",")
+		if username != "" {
+			query.Usernames = append(query.Usernames, username)
+		}
+	}
+
+	if len(query.Usernames) == 0 || i == len(args) {
+		return nil, errors.New(scheduleUsage)
+	}
+
+	duration, err := parseEventDuration(args[i])
+	if err != nil {
+		return nil, err
+	}
+	query.Duration = duration
+
+	rangeArgs := args[i+1:]
+	if len(rangeArgs) > 0 && rangeArgs[0] == "within" {
+		rangeArgs = rangeArgs[1:]
+	}
+
+	view, err := parseViewQuery(rangeArgs, now)
+	if err != nil || view.Calendar != "" {
+		return nil, errors.New(scheduleUsage)
+	}
+
+	query.From = view.From
+	if earliest := now.Add(availabilityQueryDelay); query.From.Before(earliest) {
+		query.From = earliest
+	}
+	query.To = view.To
+
+	if !query.To.After(query.From) {
+		return nil, errors.New("That range has already passed")
+	}
+
+	if query.To.After(now.AddDate(0, 0, maxScheduleDays)) {
+		return nil, fmt.Errorf("Please choose a range within the next %d days", maxScheduleDays)
+	}
+
+	return query, nil
+}
+
+func buildSchedulePeriods(from, to time.Time, duration time.Duration) []AvailabilityPeriod {
+	periods := []AvailabilityPeriod{}
+	for day := startOfDay(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !isWorkingDay(day) {
+			continue
+		}
+
+		start := day.Add(scheduleDayStart * time.Hour)
+		if start.Before(from) {
+			start = from
+		}
+
+		end := day.Add(scheduleDayEnd * time.Hour)
+		if end.After(to) {
+			end = to
+		}
+
+		if end.Sub(start) < duration {
+			continue
+		}
+
+		periods = append(periods, AvailabilityPeriod{
+			Start: start.UTC().Format(CRONOFY_DATETIME_FORMAT),
+			End:   end.UTC().Format(CRONOFY_DATETIME_FORMAT),
+		})
+	}
+
+	return periods
+}
+
+type ScheduleParticipants struct {
+	Users        []*model.User
+	Members      []AvailabilityParticipantMember
+	NotConnected []*model.User
+}
+
+func getScheduleParticipants(p *Plugin, organizerID string, usernames []string) (*ScheduleParticipants, error) {
+	organizer, appErr := p.API.GetUser(organizerID)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	participants := &ScheduleParticipants{}
+	seen := map[string]bool{}
+	users := []*model.User{organizer}
+	for _, username := range usernames {
+		user, appErr := p.API.GetUserByUsername(username)
+		if appErr != nil {
+			return nil, fmt.Errorf("No user found for @%s", username)
+		}
+		users = append(users, user)
+	}
+
+	for _, user := range users {
+		if seen[user.Id] {
+			continue
+		}
+		seen[user.Id] = true
+		participants.Users = append(participants.Users, user)
+
+		cronofyUser, err := p.getCronofyUser(user.Id)
+		if err == errNotConnected {
+			if user.Id == organizerID {
+				return nil, err
+			}
+			participants.NotConnected = append(participants.NotConnected, user)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, account := range cronofyUser.Accounts {
+			participants.Members = append(participants.Members, AvailabilityParticipantMember{Sub: account.Sub})
+		}
+	}
+
+	if len(participants.Users) < 2 {
+		return nil, errors.New("Please mention at least one other user")
+	}
+
+	return participants, nil
+}
+
+// getGroupAvailability uses the client secret, as it queries across several accounts.
+func getGroupAvailability(h IHandler, organizerID string, members []AvailabilityParticipantMember, periods []AvailabilityPeriod, duration time.Duration) ([]AvailabilityPeriod, error) {
+	client := h.MakeCronofyClient(h.GetPlugin().getConfiguration().ClientSecret)
+
+	req := AvailabilityRequest{
+		Participants: []AvailabilityParticipant{{
+			Members:  members,
+			Required: "all",
+		}},
+		RequiredDuration: AvailabilityDuration{Minutes: int(duration / time.Minute)},
+		AvailablePeriods: periods,
+		ResponseFormat:   "slots",
+	}
+
+	reqURL := "https://api.cronofy.com/v1/availability"
+	status, data, err := client.CronofyRequest(organizerID, reqURL, req)
+	if err != nil {
+		return nil, err
+	} else if status >= 300 {
+		return nil, fmt.Errorf("Cronofy returned status %d %s", status, string(data))
+	}
+
+	av := &AvailabilityResponse{}
+	err = json.Unmarshal(data, av)
+	if err != nil {
+		return nil, err
+	}
+
+	slots := av.AvailableSlots
+	sort.SliceStable(slots, func(i, j int) bool {
+		return slots[i].Start < slots[j].Start
+	})
+
+	if len(slots) > maxScheduleSlots {
+		slots = slots[:maxScheduleSlots]
+	}
+
+	return slots, nil
+}
+
+func formatMentions(users []*model.User) string {
+	mentions := []string{}
+	for _, user := range users {
+		mentions = append(mentions, "@"+user.Username)
+	}
+
+	return strings.Join(mentions, ", ")
+}
+
+func getScheduleAttachment(participants *ScheduleParticipants, slots []AvailabilityPeriod, loc *time.Location) *model.SlackAttachment {
+	userIDs := []string{}
+	for _, user := range participants.Users {
+		userIDs = append(userIDs, user.Id)
+	}
+
+	actions := []*model.PostAction{}
+	for _, slot := range slots {
+		evt := &cronofy.Event{Start: slot.Start, End: slot.End}
+		start, _, _, err := getEventTimes(evt, loc)
+		if err != nil {
+			continue
+		}
+
+		actions = append(actions, &model.PostAction{
+			Type: model.POST_ACTION_TYPE_BUTTON,
+			Name: start.Format(DEFAULT_DATETIME_FORMAT),
+			Integration: &model.PostActionIntegration{
+				URL: "/plugins/cronofy" + routeSchedulePick,
+				Context: map[string]interface{}{
+					"start":    slot.Start,
+					"end":      slot.End,
+					"user_ids": strings.Join(userIDs, ","),
+				},
+			},
+		})
+	}
+
+	return &model.SlackAttachment{
+		Text:    "Pick a time to create the event and invite everyone.",
+		Actions: actions,
+	}
+}
+
+func formatScheduleMessage(query *ScheduleQuery, participants *ScheduleParticipants, found bool) string {
+	rows := []string{
+		fmt.Sprintf("#### Meeting with %s (%s)", formatMentions(participants.Users[1:]), formatDuration(query.Duration)),
+	}
+
+	if !found {
+		rows = append(rows, fmt.Sprintf("No time between %s and %s suits everyone.", query.From.Format(DEFAULT_DATETIME_FORMAT), query.To.Format(DEFAULT_DATETIME_FORMAT)))
+	}
+
+	if len(participants.NotConnected) > 0 {
+		verb := "haven't"
+		if len(participants.NotConnected) == 1 {
+			verb = "hasn't"
+		}
+		rows = append(rows, fmt.Sprintf("%s %s connected a calendar, so their availability wasn't checked. Ask them to run `/cronofy connect`.", formatMentions(participants.NotConnected), verb))
+	}
+
+	return strings.Join(rows, "\n")
+}
+
+func httpSchedulePick(h IHandler, w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := r.Header.Get("Mattermost-User-Id")
+	if mattermostUserID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	p := h.GetPlugin()
+
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != mattermostUserID {
+		return http.StatusBadRequest, errors.New("invalid post action request")
+	}
+
+	start, _ := request.Context["start"].(string)
+	end, _ := request.Context["end"].(string)
+	ids, _ := request.Context["user_ids"].(string)
+	if start == "" || end == "" || ids == "" {
+		return http.StatusBadRequest, errors.New("missing slot in post action context")
+	}
+
+	response := &model.PostActionIntegrationResponse{}
+
+	req, calendar, uninvited, err := buildScheduledEvent(h, mattermostUserID, strings.Split(ids, ","), start, end)
+	if err == nil {
+		err = createUserEvent(h, mattermostUserID, calendar, req)
+	}
+	if err != nil {
+		response.EphemeralText = fmt.Sprintf("Failed to create the event: %s", err.Error())
+		return writePostActionResponse(w, response)
+	}
+
+	message := fmt.Sprintf("Scheduled \"%s\" for %s.", req.Summary, formatEventTimeRange(&cronofy.Event{Start: start, End: end}, p.getUserLocation(mattermostUserID)))
+	if len(uninvited) > 0 {
+		message += fmt.Sprintf(" Email addresses are hidden on this server, so these users weren't invited: %s. Please invite them yourself.", strings.Join(uninvited, ", "))
+	}
+
+	// The slots were offered in an ephemeral post, which can't be updated through the response.
+	p.API.UpdateEphemeralPost(mattermostUserID, &model.Post{
+		Id:        request.PostId,
+		UserId:    mattermostUserID,
+		ChannelId: request.ChannelId,
+		Message:   message,
+	})
+
+	return writePostActionResponse(w, response)
+}
+
+// buildScheduledEvent also returns the users not invited because their email addresses are hidden.
+func buildScheduledEvent(h IHandler, organizerID string, userIDs []string, start, end string) (*CreateEventRequest, *cronofy.Calendar, []string, error) {
+	p := h.GetPlugin()
+
+	settings, err := p.getUserSettings(organizerID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	calendars, calendarErrs, err := getUserCalendars(h, organizerID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	writable := getWritableCalendars(settings.filterCalendars(calendars))
+	if len(writable) == 0 {
+		writable = getWritableCalendars(calendars)
+	}
+	if len(writable) == 0 && len(calendarErrs) > 0 {
+		return nil, nil, nil, errors.New(strings.Join(calendarErrs, "\n"))
+	}
+	if len(writable) == 0 {
+		return nil, nil, nil, errors.New("None of your calendars can have events created in them.")
+	}
+
+	attendees := []EventAttendee{}
+	names := []string{}
+	uninvited := []string{}
+	for _, userID := range userIDs {
+		if userID == organizerID {
+			continue
+		}
+
+		user, appErr := p.API.GetUser(userID)
+		if appErr != nil {
+			return nil, nil, nil, appErr
+		}
+
+		names = append(names, user.GetDisplayName(model.SHOW_NICKNAME_FULLNAME))
+		attendee, ok := getUserAttendee(p, organizerID, user)
+		if !ok {
+			uninvited = append(uninvited, "@"+user.Username)
+			continue
+		}
+		attendees = append(attendees, attendee)
+	}
+
+	req := &CreateEventRequest{
+		EventID: model.NewId(),
+		Summary: "Meeting with " + strings.Join(names, ", "),
+		Start:   start,
+		End:     end,
+		TZID:    p.getUserLocation(organizerID).String(),
+	}
+	if len(attendees) > 0 {
+		req.Attendees = &EventAttendees{Invite: attendees}
+	}
+
+	return req, writable[0], uninvited, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScheduleQuery(t *testing.T) {
+	// A Friday afternoon.
+	now := time.Date(2019, 11, 29, 15, 0, 0, 0, time.UTC)
+
+	query, err := parseScheduleQuery([]string{"@alice,", "@bob", "30m", "within", "next", "week"}, now)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, query.Usernames)
+	assert.Equal(t, 30*time.Minute, query.Duration)
+	assert.Equal(t, time.Date(2019, 12, 2, 0, 0, 0, 0, time.UTC), query.From)
+	assert.Equal(t, time.Date(2019, 12, 9, 0, 0, 0, 0, time.UTC), query.To)
+
+	query, err = parseScheduleQuery([]string{"@alice", "1h", "today"}, now)
+	require.Nil(t, err)
+	assert.Equal(t, now.Add(availabilityQueryDelay), query.From)
+
+	// Only Friday's remaining working hours and the whole of Monday are searched.
+	periods := buildSchedulePeriods(query.From, time.Date(2019, 12, 3, 0, 0, 0, 0, time.UTC), time.Hour)
+	assert.Equal(t, []AvailabilityPeriod{
+		{Start: "2019-11-29T15:02:00Z", End: "2019-11-29T17:00:00Z"},
+		{Start: "2019-12-02T09:00:00Z", End: "2019-12-02T17:00:00Z"},
+	}, periods)
+
+	_, err = parseScheduleQuery([]string{"30m"}, now)
+	assert.EqualError(t, err, scheduleUsage)
+	_, err = parseScheduleQuery([]string{"@alice"}, now)
+	assert.EqualError(t, err, scheduleUsage)
+	_, err = parseScheduleQuery([]string{"@alice", "30m", "2020-03-01"}, now)
+	assert.NotNil(t, err)
+}
+
+func TestGetScheduleParticipants(t *testing.T) {
+	api := newFakeAPI()
+	api.users["organizer"] = &model.User{Id: "organizer", Username: "organizer"}
+	api.users["alice"] = &model.User{Id: "alice", Username: "alice"}
+	api.users["carol"] = &model.User{Id: "carol", Username: "carol"}
+	p := newTestPlugin(api)
+
+	_, err := getScheduleParticipants(p, "organizer", []string{"alice"})
+	assert.Equal(t, errNotConnected, err)
+
+	for _, id := range []string{"organizer", "alice"} {
+		account := &CronofyAccount{AccessTokenResponse: AccessTokenResponse{AccessToken: "token", Sub: "sub_" + id}}
+		require.Nil(t, p.storeCronofyUser(id, &CronofyUser{Accounts: []*CronofyAccount{account}}))
+	}
+
+	participants, err := getScheduleParticipants(p, "organizer", []string{"alice", "carol", "alice"})
+	require.Nil(t, err)
+	assert.Len(t, participants.Users, 3)
+	assert.Equal(t, []AvailabilityParticipantMember{{Sub: "sub_organizer"}, {Sub: "sub_alice"}}, participants.Members)
+	assert.Equal(t, []*model.User{api.users["carol"]}, participants.NotConnected)
+
+	query := &ScheduleQuery{Duration: 30 * time.Minute}
+	assert.Equal(t, "#### Meeting with @alice, @carol (30 minutes)\n@carol hasn't connected a calendar, so their availability wasn't checked. Ask them to run `/cronofy connect`.", formatScheduleMessage(query, participants, true))
+
+	_, err = getScheduleParticipants(p, "organizer", []string{"dave"})
+	assert.EqualError(t, err, "No user found for @dave")
+	_, err = getScheduleParticipants(p, "organizer", []string{"organizer"})
+	assert.NotNil(t, err)
+}
+
+func TestScheduleCommand(t *testing.T) {
+	api := newFakeAPI()
+	api.users["organizer"] = &model.User{Id: "organizer", Username: "organizer"}
+	api.users["alice"] = &model.User{Id: "alice", Username: "alice"}
+	p := newTestPlugin(api)
+
+	for _, id := range []string{"organizer", "alice"} {
+		account := &CronofyAccount{AccessTokenResponse: AccessTokenResponse{AccessToken: "token", Sub: "sub_" + id}}
+		require.Nil(t, p.storeCronofyUser(id, &CronofyUser{Accounts: []*CronofyAccount{account}}))
+	}
+
+	client := &fakeCronofyClient{response: []byte(`{"available_slots": [{"start": "2019-12-02T10:00:00Z", "end": "2019-12-02T10:30:00Z"}]}`)}
+	h := newFakeHandler(p, client)
+
+	header := &model.CommandArgs{UserId: "organizer", ChannelId: "channel1"}
+	commandHandler.Handle(h, nil, header, "schedule", "@alice", "30m", "within", "next", "week")
+
+	require.Len(t, client.payloads, 1)
+	assert.Equal(t, "slots", client.payloads[0].(AvailabilityRequest).ResponseFormat)
+
+	require.Len(t, api.ephemeralPosts, 1)
+	post := api.ephemeralPosts[0]
+	assert.Equal(t, "#### Meeting with @alice (30 minutes)", post.Message)
+	require.Len(t, post.Attachments(), 1)
+	assert.Len(t, post.Attachments()[0].Actions, 1)
+}
+
+func TestBuildScheduledEvent(t *testing.T) {
+	api := newFakeAPI()
+	api.users["organizer"] = &model.User{Id: "organizer", Username: "organizer"}
+	api.users["alice"] = &model.User{Id: "alice", Username: "alice", Email: "alice@example.com", FirstName: "Alice"}
+	p := newTestPlugin(api)
+	h := newFakeHandler(p, &fakeCronofyClient{calendars: []*cronofy.Calendar{{CalendarID: "cal_1"}}})
+
+	req, calendar, uninvited, err := buildScheduledEvent(h, "organizer", []string{"organizer", "alice"}, "2019-12-02T10:00:00Z", "2019-12-02T10:30:00Z")
+	require.Nil(t, err)
+	assert.Equal(t, "cal_1", calendar.CalendarID)
+	assert.Equal(t, []EventAttendee{{Email: "alice@example.com", DisplayName: "Alice"}}, req.Attendees.Invite)
+	assert.Empty(t, uninvited)
+
+	*api.config.PrivacySettings.ShowEmailAddress = false
+	req, _, uninvited, err = buildScheduledEvent(h, "organizer", []string{"organizer", "alice"}, "2019-12-02T10:00:00Z", "2019-12-02T10:30:00Z")
+	require.Nil(t, err)
+	assert.Nil(t, req.Attendees)
+	assert.Equal(t, []string{"@alice"}, uninvited)
+}
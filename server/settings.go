@@ -0,0 +1,644 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+type UserSettings struct {
+	StatusSync   bool                  `json:"status_sync"`
+	CustomStatus bool                  `json:"custom_status"`
+	Availability AvailabilityOverrides `json:"availability"`
+
+	// ReminderMinutes of zero turns reminders off.
+	ReminderMinutes int `json:"reminder_minutes"`
+
+	// DailyAgendaTime is formatted as 15:04. Empty turns the agenda off.
+	DailyAgendaTime     string `json:"daily_agenda_time"`
+	AgendaSkipEmptyDays bool   `json:"agenda_skip_empty_days"`
+	Timezone            string `json:"timezone"`
+
+	// Calendars are the included calendar IDs. Empty includes every calendar.
+	Calendars          []string          `json:"calendars"`
+	MutedNotifications []EventChangeType `json:"muted_notifications"`
+}
+
+// AvailabilityOverrides leaves unset fields to the plugin configuration.
+type AvailabilityOverrides struct {
+	Lookahead        *int  `json:"lookahead,omitempty"`
+	RequiredDuration *int  `json:"required_duration,omitempty"`
+	BufferBefore     *int  `json:"buffer_before,omitempty"`
+	BufferAfter      *int  `json:"buffer_after,omitempty"`
+	UseFreeBusy      *bool `json:"use_free_busy,omitempty"`
+}
+
+func (o AvailabilityOverrides) apply(opts *AvailabilityOptions) *AvailabilityOptions {
+	result := *opts
+	if o.Lookahead != nil {
+		result.Lookahead = *o.Lookahead
+	}
+	if o.RequiredDuration != nil {
+		result.RequiredDuration = *o.RequiredDuration
+	}
+	if o.BufferBefore != nil {
+		result.BufferBefore = *o.BufferBefore
+	}
+	if o.BufferAfter != nil {
+		result.BufferAfter = *o.BufferAfter
+	}
+	if o.UseFreeBusy != nil {
+		result.UseFreeBusy = *o.UseFreeBusy
+	}
+
+	return &result
+}
+
+const (
+	maxReminderMinutes = 24 * 60
+	agendaTimeFormat   = "15:04"
+
+	calendarDialogElementPrefix = "calendar_"
+)
+
+func (s *UserSettings) includesCalendar(calendarID string) bool {
+	if len(s.Calendars) == 0 {
+		return true
+	}
+
+	for _, id := range s.Calendars {
+		if id == calendarID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *UserSettings) filterCalendars(calendars []*cronofy.Calendar) []*cronofy.Calendar {
+	result := []*cronofy.Calendar{}
+	for _, c := range calendars {
+		if s.includesCalendar(c.CalendarID) {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
+
+func (s *UserSettings) isMuted(t EventChangeType) bool {
+	for _, muted := range s.MutedNotifications {
+		if muted == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *UserSettings) filterChanges(changes []*EventChange) []*EventChange {
+	result := []*EventChange{}
+	for _, change := range changes {
+		if !s.includesCalendar(change.Event.CalendarID) {
+			continue
+		}
+
+		for _, t := range change.Types {
+			if !s.isMuted(t) {
+				result = append(result, change)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+func (s *UserSettings) setReminder(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "off" {
+		s.ReminderMinutes = 0
+		return nil
+	}
+
+	minutes, err := strconv.Atoi(strings.TrimSuffix(value, "m"))
+	if err != nil || minutes < 1 || minutes > maxReminderMinutes {
+		return fmt.Errorf("The reminder time must be between 1 and %d minutes, or off", maxReminderMinutes)
+	}
+
+	s.ReminderMinutes = minutes
+	return nil
+}
+
+func (s *UserSettings) setDailyAgendaTime(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "off" {
+		s.DailyAgendaTime = ""
+		return nil
+	}
+
+	t, err := time.Parse(agendaTimeFormat, value)
+	if err != nil {
+		return errors.New("The agenda time must be a 24-hour time such as 09:00, or off")
+	}
+
+	s.DailyAgendaTime = t.Format(agendaTimeFormat)
+	return nil
+}
+
+func (s *UserSettings) setTimezone(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "auto" {
+		s.Timezone = ""
+		return nil
+	}
+
+	_, err := time.LoadLocation(value)
+	if err != nil {
+		return fmt.Errorf("%s is not a known timezone. Use a name such as Europe/London, or auto", value)
+	}
+
+	s.Timezone = value
+	return nil
+}
+
+// setCalendars takes 1-based positions, calendar IDs, unambiguous names, or "all".
+func (s *UserSettings) setCalendars(choices []string, calendars []*cronofy.Calendar) error {
+	if len(choices) == 0 || (len(choices) == 1 && choices[0] == "all") {
+		s.Calendars = nil
+		return nil
+	}
+
+	ids := []string{}
+	for _, choice := range choices {
+		choice = strings.TrimSpace(choice)
+		if choice == "" {
+			continue
+		}
+
+		calendar, err := findCalendar(calendars, choice)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, calendar.CalendarID)
+	}
+
+	s.Calendars = ids
+	return nil
+}
+
+// setIncludedCalendars stores no IDs when every calendar is included, so later ones are too.
+func (s *UserSettings) setIncludedCalendars(calendars []*cronofy.Calendar, include func(c *cronofy.Calendar) bool) error {
+	ids := []string{}
+	for _, c := range calendars {
+		if include(c) {
+			ids = append(ids, c.CalendarID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return errors.New("Please include at least one calendar.")
+	}
+
+	if len(ids) == len(calendars) {
+		ids = nil
+	}
+
+	s.Calendars = ids
+	return nil
+}
+
+func findCalendar(calendars []*cronofy.Calendar, s string) (*cronofy.Calendar, error) {
+	var match *cronofy.Calendar
+	for i, c := range calendars {
+		if s == strconv.Itoa(i+1) || s == c.CalendarID {
+			return c, nil
+		}
+
+		if strings.EqualFold(s, c.CalendarName) {
+			if match != nil {
+				return nil, fmt.Errorf("More than one calendar is named %s. Please choose it by its number.", s)
+			}
+			match = c
+		}
+	}
+
+	if match == nil {
+		return nil, fmt.Errorf("No calendar matched %s", s)
+	}
+
+	return match, nil
+}
+
+func (s *UserSettings) setMuted(names []string, mute bool) error {
+	for _, name := range names {
+		t := parseEventChangeType(name)
+		if t == "" {
+			return fmt.Errorf("Unknown notification type %s. The types are: %s", name, strings.Join(eventChangeTypeNames(), ", "))
+		}
+
+		muted := []EventChangeType{}
+		for _, m := range s.MutedNotifications {
+			if m != t {
+				muted = append(muted, m)
+			}
+		}
+		if mute {
+			muted = append(muted, t)
+		}
+		s.MutedNotifications = muted
+	}
+
+	return nil
+}
+
+func parseEventChangeType(name string) EventChangeType {
+	name = strings.TrimSpace(strings.Replace(name, "-", "_", -1))
+	for _, t := range eventChangeTypes {
+		if string(t) == name {
+			return t
+		}
+	}
+
+	return ""
+}
+
+func eventChangeTypeNames() []string {
+	names := []string{}
+	for _, t := range eventChangeTypes {
+		names = append(names, string(t))
+	}
+
+	return names
+}
+
+func formatCalendarName(c *cronofy.Calendar) string {
+	return fmt.Sprintf("%s (%s)", c.CalendarName, c.ProfileName)
+}
+
+func formatUserSettings(s *UserSettings, calendars []*cronofy.Calendar, errs []string) string {
+	onOff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+
+	reminder := "off"
+	if s.ReminderMinutes > 0 {
+		reminder = fmt.Sprintf("%d minutes before each event", s.ReminderMinutes)
+	}
+
+	agenda := "off"
+	if s.DailyAgendaTime != "" {
+		agenda = s.DailyAgendaTime + " on working days"
+		if s.AgendaSkipEmptyDays {
+			agenda += ", except days with no events"
+		}
+	}
+
+	timezone := "automatic"
+	if s.Timezone != "" {
+		timezone = s.Timezone
+	}
+
+	muted := "none"
+	if len(s.MutedNotifications) > 0 {
+		names := []string{}
+		for _, t := range s.MutedNotifications {
+			names = append(names, string(t))
+		}
+		muted = strings.Join(names, ", ")
+	}
+
+	rows := []string{
+		"#### Calendar settings",
+		fmt.Sprintf("* Status sync: %s", onOff(s.StatusSync)),
+		fmt.Sprintf("* Custom status: %s", onOff(s.CustomStatus)),
+		fmt.Sprintf("* Reminders: %s", reminder),
+		fmt.Sprintf("* Daily agenda: %s", agenda),
+		fmt.Sprintf("* Timezone: %s", timezone),
+		fmt.Sprintf("* Muted notifications: %s", muted),
+		"* Calendars:",
+	}
+
+	for i, c := range calendars {
+		check := " "
+		if s.includesCalendar(c.CalendarID) {
+			check = "x"
+		}
+		rows = append(rows, fmt.Sprintf("    %d. [%s] %s", i+1, check, formatCalendarName(c)))
+	}
+
+	text := strings.Join(rows, "\n")
+	if len(errs) > 0 {
+		text += "\n\nSome of your calendars couldn't be read, so they aren't listed:\n* " + strings.Join(errs, "\n* ")
+	}
+
+	return text
+}
+
+func formatJobDisabledWarning(p *Plugin, s *UserSettings) string {
+	if p.getConfiguration().EnableAvailabilityJob {
+		return ""
+	}
+
+	features := []string{}
+	if s.StatusSync {
+		features = append(features, "status sync")
+	}
+	if s.CustomStatus {
+		features = append(features, "custom status")
+	}
+	if s.ReminderMinutes > 0 {
+		features = append(features, "reminders")
+	}
+	if s.DailyAgendaTime != "" {
+		features = append(features, "the daily agenda")
+	}
+
+	if len(features) == 0 {
+		return ""
+	}
+
+	list := features[len(features)-1]
+	if len(features) > 1 {
+		list = strings.Join(features[:len(features)-1], ", ") + " and " + list
+	}
+
+	return fmt.Sprintf("\n\nThe recurring availability job is turned off for this server, so %s won't run until a system admin enables it.", list)
+}
+
+// getUserCalendars also returns the accounts whose calendars couldn't be read.
+func getUserCalendars(h IHandler, userID string) ([]*cronofy.Calendar, []string, error) {
+	clients, err := h.MakeUserCronofyClients(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	calendars := []*cronofy.Calendar{}
+	errs := []string{}
+	for _, ac := range clients {
+		accountCalendars, err := ac.Client.GetCalendars()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Error fetching calendars for %s: %s", ac.Account.describeProfiles(), err.Error()))
+			continue
+		}
+		calendars = append(calendars, accountCalendars...)
+	}
+
+	return calendars, errs, nil
+}
+
+func saveUserSettings(h IHandler, userID string, prev, settings *UserSettings) error {
+	p := h.GetPlugin()
+
+	err := p.storeUserSettings(userID, settings)
+	if err != nil {
+		return err
+	}
+
+	if prev.StatusSync && !settings.StatusSync {
+		_, err = restoreUserStatus(h, userID)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to restore your status")
+		}
+	}
+
+	if prev.CustomStatus && !settings.CustomStatus {
+		err = clearUserCustomStatus(h, userID)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to clear your custom status")
+		}
+	}
+
+	return nil
+}
+
+func openSettingsDialog(h IHandler, header *model.CommandArgs) error {
+	p := h.GetPlugin()
+
+	settings, err := p.getUserSettings(header.UserId)
+	if err != nil {
+		return err
+	}
+
+	calendars, _, err := getUserCalendars(h, header.UserId)
+	if err != nil {
+		return err
+	}
+
+	onOffOptions := []*model.PostActionOptions{{Text: "On", Value: "on"}, {Text: "Off", Value: "off"}}
+	onOff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+
+	reminder := ""
+	if settings.ReminderMinutes > 0 {
+		reminder = strconv.Itoa(settings.ReminderMinutes)
+	}
+
+	muted := []string{}
+	for _, t := range settings.MutedNotifications {
+		muted = append(muted, string(t))
+	}
+
+	elements := []model.DialogElement{
+		{DisplayName: "Status sync", Name: "status_sync", Type: "select", Options: onOffOptions, Default: onOff(settings.StatusSync)},
+		{DisplayName: "Custom status", Name: "custom_status", Type: "select", Options: onOffOptions, Default: onOff(settings.CustomStatus)},
+		{
+			DisplayName: "Reminder (minutes before events)",
+			Name:        "reminder_minutes",
+			Type:        "text",
+			SubType:     "number",
+			Default:     reminder,
+			Placeholder: "Off",
+			Optional:    true,
+		},
+		{
+			DisplayName: "Daily agenda time",
+			Name:        "daily_agenda_time",
+			Type:        "text",
+			Default:     settings.DailyAgendaTime,
+			Placeholder: "Off",
+			HelpText:    "A 24-hour time such as 09:00. The agenda is sent on working days.",
+			Optional:    true,
+		},
+		{DisplayName: "Skip the agenda on days with no events", Name: "agenda_skip_empty_days", Type: "select", Options: onOffOptions, Default: onOff(settings.AgendaSkipEmptyDays)},
+		{
+			DisplayName: "Timezone",
+			Name:        "timezone",
+			Type:        "text",
+			Default:     settings.Timezone,
+			Placeholder: "Automatic",
+			HelpText:    "A timezone such as Europe/London. Leave blank to use your Mattermost timezone.",
+			Optional:    true,
+		},
+		{
+			DisplayName: "Muted notifications",
+			Name:        "muted_notifications",
+			Type:        "text",
+			Default:     strings.Join(muted, ", "),
+			HelpText:    fmt.Sprintf("Comma-separated. The types are: %s", strings.Join(eventChangeTypeNames(), ", ")),
+			Optional:    true,
+		},
+	}
+
+	// Elements are named by calendar ID, as calendars may share a name.
+	includeOptions := []*model.PostActionOptions{{Text: "Include", Value: "include"}, {Text: "Exclude", Value: "exclude"}}
+	for _, c := range calendars {
+		include := "exclude"
+		if settings.includesCalendar(c.CalendarID) {
+			include = "include"
+		}
+		elements = append(elements, model.DialogElement{
+			DisplayName: formatCalendarName(c),
+			Name:        calendarDialogElementPrefix + c.CalendarID,
+			Type:        "select",
+			Options:     includeOptions,
+			Default:     include,
+		})
+	}
+
+	appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: header.TriggerId,
+		URL:       "/plugins/cronofy" + routeSettingsDialog,
+		Dialog: model.Dialog{
+			Title:       "Calendar settings",
+			SubmitLabel: "Save",
+			Elements:    elements,
+		},
+	})
+	if appErr != nil {
+		return appErr
+	}
+
+	return nil
+}
+
+func httpSubmitSettingsDialog(h IHandler, w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := r.Header.Get("Mattermost-User-Id")
+	if mattermostUserID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	p := h.GetPlugin()
+
+	request := model.SubmitDialogRequestFromJson(r.Body)
+	if request == nil || request.UserId != mattermostUserID {
+		return http.StatusBadRequest, errors.New("invalid dialog submission")
+	}
+
+	if request.Cancelled {
+		return http.StatusOK, nil
+	}
+
+	prev, err := p.getUserSettings(mattermostUserID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	calendars, calendarErrs, err := getUserCalendars(h, mattermostUserID)
+	if err != nil {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Error: err.Error()})
+	}
+
+	value := func(name string) string {
+		switch v := request.Submission[name].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return ""
+	}
+
+	settings := *prev
+	settings.StatusSync = value("status_sync") == "on"
+	settings.CustomStatus = value("custom_status") == "on"
+	settings.AgendaSkipEmptyDays = value("agenda_skip_empty_days") == "on"
+
+	errs := map[string]string{}
+	if settings.CustomStatus && !prev.CustomStatus && !p.supportsCustomStatus() {
+		errs["custom_status"] = errCustomStatusNotSupported.Error()
+	}
+	if err = settings.setReminder(value("reminder_minutes")); err != nil {
+		errs["reminder_minutes"] = err.Error()
+	}
+	if err = settings.setDailyAgendaTime(value("daily_agenda_time")); err != nil {
+		errs["daily_agenda_time"] = err.Error()
+	}
+	if err = settings.setTimezone(value("timezone")); err != nil {
+		errs["timezone"] = err.Error()
+	}
+	// Unreadable accounts' calendars would be dropped, so the selection is kept.
+	if len(calendarErrs) == 0 {
+		err = settings.setIncludedCalendars(calendars, func(c *cronofy.Calendar) bool {
+			include := value(calendarDialogElementPrefix + c.CalendarID)
+			if include == "" {
+				return prev.includesCalendar(c.CalendarID)
+			}
+			return include == "include"
+		})
+		if err != nil && len(calendars) > 0 {
+			errs[calendarDialogElementPrefix+calendars[0].CalendarID] = err.Error()
+		}
+	}
+	settings.MutedNotifications = nil
+	if err = settings.setMuted(splitList(value("muted_notifications"), ","), true); err != nil {
+		errs["muted_notifications"] = err.Error()
+	}
+
+	if len(errs) > 0 {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Errors: errs})
+	}
+
+	err = saveUserSettings(h, mattermostUserID, prev, &settings)
+	if err != nil {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Error: err.Error()})
+	}
+
+	_ = p.API.SendEphemeralPost(mattermostUserID, &model.Post{
+		UserId:    mattermostUserID,
+		ChannelId: request.ChannelId,
+		Message:   formatUserSettings(&settings, calendars, calendarErrs) + formatJobDisabledWarning(p, &settings),
+	})
+
+	return http.StatusOK, nil
+}
+
+func splitList(s, sep string) []string {
+	result := []string{}
+	for _, item := range strings.Split(s, sep) {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+func writeDialogResponse(w http.ResponseWriter, response *model.SubmitDialogResponse) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
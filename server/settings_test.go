@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserSettings(t *testing.T) {
+	calendars := []*cronofy.Calendar{
+		{CalendarID: "cal_1", CalendarName: "Work"},
+		{CalendarID: "cal_2", CalendarName: "Home"},
+	}
+
+	t.Run("validates values", func(t *testing.T) {
+		s := &UserSettings{}
+		require.Nil(t, s.setReminder("10m"))
+		assert.Equal(t, 10, s.ReminderMinutes)
+		assert.NotNil(t, s.setReminder("soon"))
+
+		require.Nil(t, s.setDailyAgendaTime("9:30"))
+		assert.Equal(t, "09:30", s.DailyAgendaTime)
+		assert.NotNil(t, s.setDailyAgendaTime("9am"))
+
+		require.Nil(t, s.setTimezone("Europe/London"))
+		assert.NotNil(t, s.setTimezone("Nowhere/Special"))
+		require.Nil(t, s.setTimezone("auto"))
+		assert.Equal(t, "", s.Timezone)
+	})
+
+	t.Run("filters calendars and muted changes", func(t *testing.T) {
+		s := &UserSettings{}
+		require.Nil(t, s.setCalendars([]string{"work"}, calendars))
+		assert.Equal(t, []string{"cal_1"}, s.Calendars)
+		assert.Len(t, s.filterCalendars(calendars), 1)
+		assert.NotNil(t, s.setCalendars([]string{"3"}, calendars))
+
+		all := &UserSettings{}
+		require.Nil(t, all.setIncludedCalendars(calendars, func(c *cronofy.Calendar) bool { return true }))
+		assert.Nil(t, all.Calendars)
+		assert.NotNil(t, all.setIncludedCalendars(calendars, func(c *cronofy.Calendar) bool { return false }))
+
+		require.Nil(t, s.setMuted([]string{"new-event", "location_changed"}, true))
+		require.Nil(t, s.setMuted([]string{"location_changed"}, false))
+		assert.Equal(t, []EventChangeType{EventChangeNewEvent}, s.MutedNotifications)
+		assert.NotNil(t, s.setMuted([]string{"everything"}, true))
+
+		changes := []*EventChange{
+			{Event: &cronofy.Event{CalendarID: "cal_1"}, Types: []EventChangeType{EventChangeNewEvent}},
+			{Event: &cronofy.Event{CalendarID: "cal_1"}, Types: []EventChangeType{EventChangeRescheduled}},
+			{Event: &cronofy.Event{CalendarID: "cal_2"}, Types: []EventChangeType{EventChangeRescheduled}},
+		}
+		filtered := s.filterChanges(changes)
+		require.Len(t, filtered, 1)
+		assert.Equal(t, changes[1], filtered[0])
+	})
+}
+
+func TestFormatJobDisabledWarning(t *testing.T) {
+	p := newTestPlugin(newFakeAPI())
+
+	assert.Empty(t, formatJobDisabledWarning(p, &UserSettings{}))
+	assert.Contains(t, formatJobDisabledWarning(p, &UserSettings{ReminderMinutes: 10, DailyAgendaTime: "09:00"}), "so reminders and the daily agenda won't run")
+
+	p.setConfiguration(&configuration{EnableAvailabilityJob: true})
+	assert.Empty(t, formatJobDisabledWarning(p, &UserSettings{ReminderMinutes: 10}))
+}
+
+func TestUpdateSettingsWithUnreadableAccount(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api)
+	require.Nil(t, p.storeCronofyUser("user1", &CronofyUser{Accounts: []*CronofyAccount{{AccessTokenResponse: AccessTokenResponse{AccountId: "acc_1"}}}}))
+	h := newFakeHandler(p, &fakeCronofyClient{calendarsErr: errors.New("token revoked")})
+	header := &model.CommandArgs{UserId: "user1"}
+
+	executeSettingsStatusSync(h, nil, header, "on")
+	settings, err := p.getUserSettings("user1")
+	require.Nil(t, err)
+	assert.True(t, settings.StatusSync)
+	assert.Contains(t, api.ephemeralPosts[0].Message, "token revoked")
+
+	executeSettingsCalendars(h, nil, header, "1")
+	assert.Contains(t, api.ephemeralPosts[1].Message, "can't be changed right now")
+}
+
+func TestFindCalendar(t *testing.T) {
+	// Calendars in different accounts often share a name.
+	calendars := []*cronofy.Calendar{
+		{CalendarID: "cal_1", CalendarName: "Calendar", ProfileName: "someone@gmail.com"},
+		{CalendarID: "cal_2", CalendarName: "Calendar", ProfileName: "someone@example.com"},
+		{CalendarID: "cal_3", CalendarName: "Holidays", ProfileName: "someone@example.com"},
+	}
+
+	s := &UserSettings{}
+	require.Nil(t, s.setCalendars([]string{"2", "holidays"}, calendars))
+	assert.Equal(t, []string{"cal_2", "cal_3"}, s.Calendars)
+
+	require.Nil(t, s.setCalendars([]string{"cal_1"}, calendars))
+	assert.Equal(t, []string{"cal_1"}, s.Calendars)
+
+	assert.NotNil(t, s.setCalendars([]string{"calendar"}, calendars), "ambiguous name")
+	assert.Equal(t, []string{"cal_1"}, s.Calendars)
+}
+
+func TestGetUserLocation(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api)
+	api.users["user1"] = &model.User{Id: "user1", Timezone: model.StringMap{
+		"useAutomaticTimezone": "true",
+		"automaticTimezone":    "Europe/Berlin",
+		"manualTimezone":       "America/New_York",
+	}}
+
+	assert.Equal(t, "Europe/Berlin", p.getUserLocation("user1").String())
+
+	api.users["user1"].Timezone["useAutomaticTimezone"] = "false"
+	assert.Equal(t, "America/New_York", p.getUserLocation("user1").String())
+
+	require.Nil(t, p.storeUserSettings("user1", &UserSettings{Timezone: "Asia/Tokyo"}))
+	assert.Equal(t, "Asia/Tokyo", p.getUserLocation("user1").String())
+
+	assert.Equal(t, time.UTC, p.getUserLocation("unknown"))
+}
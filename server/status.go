@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+type StatusChange struct {
+	PreviousStatus string    `json:"previous_status"`
+	Status         string    `json:"status"`
+	ChangedAt      time.Time `json:"changed_at"`
+
+	// ManuallyChanged leaves the user's own status alone until the busy period ends.
+	ManuallyChanged bool `json:"manually_changed"`
+}
+
+func updateUserStatusWithAvailabilities(h IHandler, userID string, availabilities *AvailabilityResponse) (string, error) {
+	p := h.GetPlugin()
+
+	prevStatus, appErr := p.API.GetUserStatus(userID)
+	if appErr != nil {
+		return "", appErr
+	}
+
+	change, err := p.getStatusChange(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(availabilities.AvailablePeriods) == 0 {
+		if change != nil {
+			if change.ManuallyChanged {
+				return fmt.Sprintf(`User is not available. User changed their status to "%s" themselves.`, prevStatus.Status), nil
+			}
+
+			if prevStatus.Status != change.Status {
+				change.ManuallyChanged = true
+				err = p.storeStatusChange(userID, change)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf(`User is not available. User changed their status to "%s" themselves.`, prevStatus.Status), nil
+			}
+
+			return fmt.Sprintf(`User is not available. Status is still "%s"`, prevStatus.Status), nil
+		}
+
+		if prevStatus.Status == "dnd" {
+			return "User is not available. User is already DND.", nil
+		}
+
+		err = p.storeStatusChange(userID, &StatusChange{
+			PreviousStatus: prevStatus.Status,
+			Status:         "dnd",
+			ChangedAt:      time.Now(),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		nextStatus, appErr := p.API.UpdateUserStatus(userID, "dnd")
+		if appErr != nil {
+			_ = p.deleteStatusChange(userID)
+			return "", appErr
+		}
+
+		return fmt.Sprintf(`User is not available. Old status "%s", New status "%s"`, prevStatus.Status, nextStatus.Status), nil
+	}
+
+	if change == nil {
+		return fmt.Sprintf(`User is available. Status is still %s`, prevStatus.Status), nil
+	}
+
+	return restoreUserStatus(h, userID)
+}
+
+func restoreUserStatus(h IHandler, userID string) (string, error) {
+	p := h.GetPlugin()
+
+	change, err := p.getStatusChange(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if change == nil {
+		return "", nil
+	}
+
+	err = p.deleteStatusChange(userID)
+	if err != nil {
+		return "", err
+	}
+
+	prevStatus, appErr := p.API.GetUserStatus(userID)
+	if appErr != nil {
+		return "", appErr
+	}
+
+	if change.ManuallyChanged || prevStatus.Status != change.Status {
+		return fmt.Sprintf(`User is available. User changed their status to "%s" themselves, so it is kept.`, prevStatus.Status), nil
+	}
+
+	nextStatus, appErr := p.API.UpdateUserStatus(userID, change.PreviousStatus)
+	if appErr != nil {
+		return "", errors.Wrap(appErr, "Failed to restore user status")
+	}
+
+	return fmt.Sprintf(`User is available. Old status "%s", Restored status "%s"`, prevStatus.Status, nextStatus.Status), nil
+}
+
+type CustomStatus struct {
+	Emoji     string    `json:"emoji"`
+	Text      string    `json:"text"`
+	Duration  string    `json:"duration,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const (
+	customStatusPropKey   = "customStatus"
+	customStatusMaxLength = 100
+
+	customStatusMinServerVersion = "5.36.0"
+)
+
+var errCustomStatusNotSupported = fmt.Errorf("Custom statuses need Mattermost server %s or later.", customStatusMinServerVersion)
+
+func (p *Plugin) supportsCustomStatus() bool {
+	return isVersionAtLeast(p.API.GetServerVersion(), customStatusMinServerVersion)
+}
+
+func isVersionAtLeast(version, min string) bool {
+	parse := func(v string) []int {
+		parts := strings.SplitN(strings.TrimPrefix(v, "v"), ".", 3)
+		numbers := make([]int, 3)
+		for i, part := range parts {
+			numbers[i], _ = strconv.Atoi(strings.SplitN(part, "-", 2)[0])
+		}
+		return numbers
+	}
+
+	v, m := parse(version), parse(min)
+	for i := range v {
+		if v[i] != m[i] {
+			return v[i] > m[i]
+		}
+	}
+
+	return true
+}
+
+var outOfOfficeKeywords = []string{"out of office", "ooo", "vacation", "holiday", "pto"}
+
+// getCurrentEvent prefers the busy event ending last, so the status lasts as long as possible.
+func getCurrentEvent(events []*cronofy.Event, now time.Time) *cronofy.Event {
+	var current *cronofy.Event
+	var currentEnd time.Time
+	for _, evt := range events {
+		if evt.Transparency == "transparent" || isEventRemoved(evt) || evt.Declined() {
+			continue
+		}
+
+		start, end, _, err := getEventTimes(evt, now.Location())
+		if err != nil || now.Before(start) || !now.Before(end) {
+			continue
+		}
+
+		if current == nil || end.After(currentEnd) {
+			current = evt
+			currentEnd = end
+		}
+	}
+
+	return current
+}
+
+func isOutOfOffice(evt *cronofy.Event) bool {
+	summary := strings.ToLower(evt.Summary)
+	for _, keyword := range outOfOfficeKeywords {
+		if strings.Contains(summary, keyword) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func buildCustomStatus(evt *cronofy.Event, now time.Time, loc *time.Location) *CustomStatus {
+	start, end, allDay, _ := getEventTimes(evt, loc)
+
+	// Events spanning days are shown until a day rather than a time.
+	until := end.Format(DEFAULT_TIME_FORMAT)
+	if allDay || len(eventDays(start, end)) > 1 {
+		lastDay := end
+		if allDay {
+			lastDay = end.AddDate(0, 0, -1)
+		}
+		until = lastDay.Format(DEFAULT_DATE_FORMAT)
+		if lastDay.Sub(now) < 7*24*time.Hour {
+			until = lastDay.Format("Monday")
+		}
+	}
+
+	var status *CustomStatus
+	switch {
+	case evt.EventPrivate:
+		status = &CustomStatus{Emoji: "calendar", Text: "Busy"}
+	case isOutOfOffice(evt):
+		status = &CustomStatus{Emoji: "palm_tree", Text: fmt.Sprintf("Out of office until %s", until)}
+	default:
+		text := fmt.Sprintf("In a meeting until %s", until)
+		if evt.Summary != "" {
+			text = fmt.Sprintf("In %s until %s", evt.Summary, until)
+		}
+		status = &CustomStatus{Emoji: "calendar", Text: text}
+	}
+
+	if text := []rune(status.Text); len(text) > customStatusMaxLength {
+		status.Text = string(text[:customStatusMaxLength-3]) + "..."
+	}
+	status.Duration = "date_and_time"
+	status.ExpiresAt = end
+
+	return status
+}
+
+func updateUserCustomStatus(h IHandler, userID string, settings *UserSettings) (string, error) {
+	p := h.GetPlugin()
+
+	now := time.Now().In(p.getUserLocation(userID))
+
+	previous, schedule, err := p.getReminderSchedule(userID)
+	if err != nil {
+		return "", err
+	}
+
+	lead := time.Duration(settings.ReminderMinutes) * time.Minute
+	_, refreshed, err := schedule.refreshIfNeeded(h, userID, lead, now)
+	if err != nil {
+		return "", err
+	}
+
+	if refreshed {
+		// If another node stored the events first, they're read again on the next refresh.
+		_, err = p.compareAndStoreReminderSchedule(userID, previous, schedule)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	stored, err := p.getCustomStatus(userID)
+	if err != nil {
+		return "", err
+	}
+
+	evt := getCurrentEvent(schedule.Events, now)
+	if evt == nil {
+		if stored == "" {
+			return "User is not in an event.", nil
+		}
+
+		err = clearUserCustomStatus(h, userID)
+		if err != nil {
+			return "", err
+		}
+
+		return "Event has ended. Cleared custom status.", nil
+	}
+
+	data, err := json.Marshal(buildCustomStatus(evt, now, now.Location()))
+	if err != nil {
+		return "", err
+	}
+
+	if stored == string(data) {
+		return "Custom status is up to date.", nil
+	}
+
+	// The plugin API can't set a single prop, so the user is read just before being updated.
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return "", appErr
+	}
+
+	current := user.Props[customStatusPropKey]
+	if current != "" && current != stored && current != string(data) {
+		return "User has set their own custom status.", nil
+	}
+
+	if current != string(data) {
+		if user.Props == nil {
+			user.Props = model.StringMap{}
+		}
+		user.Props[customStatusPropKey] = string(data)
+		_, appErr = p.API.UpdateUser(user)
+		if appErr != nil {
+			return "", appErr
+		}
+	}
+
+	err = p.storeCustomStatus(userID, string(data))
+	if err != nil {
+		return "", err
+	}
+
+	return "Set custom status from the current event.", nil
+}
+
+func clearUserCustomStatus(h IHandler, userID string) error {
+	p := h.GetPlugin()
+
+	stored, err := p.getCustomStatus(userID)
+	if err != nil || stored == "" {
+		return err
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return appErr
+	}
+
+	if user.Props[customStatusPropKey] == stored {
+		delete(user.Props, customStatusPropKey)
+		_, appErr = p.API.UpdateUser(user)
+		if appErr != nil {
+			return appErr
+		}
+	}
+
+	return p.deleteCustomStatus(userID)
+}
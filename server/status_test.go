@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateUserStatusWithAvailabilities(t *testing.T) {
+	busy := &AvailabilityResponse{}
+	free := &AvailabilityResponse{AvailablePeriods: []AvailabilityPeriod{{Start: "2019-11-25T19:00:00Z", End: "2019-11-25T19:15:00Z"}}}
+
+	t.Run("restores the previous status", func(t *testing.T) {
+		api := newFakeAPI()
+		h := &Handler{plugin: newTestPlugin(api)}
+		api.statuses["user1"] = "away"
+
+		_, err := updateUserStatusWithAvailabilities(h, "user1", busy)
+		require.Nil(t, err)
+		assert.Equal(t, "dnd", api.statuses["user1"])
+
+		_, err = updateUserStatusWithAvailabilities(h, "user1", free)
+		require.Nil(t, err)
+		assert.Equal(t, "away", api.statuses["user1"])
+	})
+
+	t.Run("leaves a status set by the user before the meeting", func(t *testing.T) {
+		api := newFakeAPI()
+		h := &Handler{plugin: newTestPlugin(api)}
+		api.statuses["user1"] = "dnd"
+
+		_, err := updateUserStatusWithAvailabilities(h, "user1", busy)
+		require.Nil(t, err)
+		_, err = updateUserStatusWithAvailabilities(h, "user1", free)
+		require.Nil(t, err)
+		assert.Equal(t, "dnd", api.statuses["user1"])
+	})
+
+	t.Run("leaves a status changed by the user during the meeting", func(t *testing.T) {
+		api := newFakeAPI()
+		h := &Handler{plugin: newTestPlugin(api)}
+		api.statuses["user1"] = "online"
+
+		_, err := updateUserStatusWithAvailabilities(h, "user1", busy)
+		require.Nil(t, err)
+
+		api.statuses["user1"] = "away"
+		_, err = updateUserStatusWithAvailabilities(h, "user1", busy)
+		require.Nil(t, err)
+		assert.Equal(t, "away", api.statuses["user1"])
+
+		_, err = updateUserStatusWithAvailabilities(h, "user1", free)
+		require.Nil(t, err)
+		assert.Equal(t, "away", api.statuses["user1"])
+	})
+}
+
+func TestBuildCustomStatus(t *testing.T) {
+	now := time.Date(2019, 11, 25, 19, 10, 0, 0, time.UTC)
+	end := time.Date(2019, 11, 25, 19, 45, 0, 0, time.UTC)
+
+	standup := &cronofy.Event{Summary: "Standup", Start: "2019-11-25T19:00:00Z", End: "2019-11-25T19:45:00Z"}
+	free := &cronofy.Event{Summary: "Focus time", Start: "2019-11-25T19:00:00Z", End: "2019-11-25T19:45:00Z", Transparency: "transparent"}
+
+	evt := getCurrentEvent([]*cronofy.Event{free, standup}, now)
+	require.Equal(t, standup, evt)
+
+	status := buildCustomStatus(evt, now, time.UTC)
+	assert.Equal(t, "In Standup until 7:45 PM", status.Text)
+	assert.Equal(t, end, status.ExpiresAt)
+
+	private := &cronofy.Event{Summary: "Interview", Start: "2019-11-25T19:00:00Z", End: "2019-11-25T19:45:00Z", EventPrivate: true}
+	assert.Equal(t, "Busy", buildCustomStatus(private, now, time.UTC).Text)
+
+	assert.Nil(t, getCurrentEvent([]*cronofy.Event{standup}, end))
+
+	vacation := &cronofy.Event{Summary: "Vacation", Start: "2019-11-25", End: "2019-11-28"}
+	require.Equal(t, vacation, getCurrentEvent([]*cronofy.Event{vacation}, now))
+	assert.Equal(t, "Out of office until Wednesday", buildCustomStatus(vacation, now, time.UTC).Text)
+}
+
+func TestUpdateUserCustomStatus(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api)
+	api.users["user1"] = &model.User{Id: "user1"}
+
+	now := time.Now().UTC()
+	standup := &cronofy.Event{EventUID: "evt_1", Summary: "Standup", Start: now.Add(-10 * time.Minute).Format(time.RFC3339), End: now.Add(30 * time.Minute).Format(time.RFC3339)}
+	client := &fakeCronofyClient{calendars: []*cronofy.Calendar{{CalendarID: "cal_1"}}, events: []*cronofy.Event{standup}}
+	h := newFakeHandler(p, client)
+	settings := &UserSettings{CustomStatus: true}
+
+	_, err := updateUserCustomStatus(h, "user1", settings)
+	require.Nil(t, err)
+	assert.Contains(t, api.users["user1"].Props[customStatusPropKey], "In Standup until")
+
+	// The events are cached between refreshes.
+	res, err := updateUserCustomStatus(h, "user1", settings)
+	require.Nil(t, err)
+	assert.Equal(t, "Custom status is up to date.", res)
+	assert.Len(t, client.requests, 1)
+
+	api.users["user1"].Props[customStatusPropKey] = `{"text":"Lunch"}`
+	require.Nil(t, clearUserCustomStatus(h, "user1"))
+	assert.Equal(t, `{"text":"Lunch"}`, api.users["user1"].Props[customStatusPropKey])
+}
+
+func TestCustomStatusLimits(t *testing.T) {
+	now := time.Date(2019, 11, 25, 19, 10, 0, 0, time.UTC)
+
+	long := &cronofy.Event{Summary: strings.Repeat("会議", 60), Start: "2019-11-25T19:00:00Z", End: "2019-11-25T19:45:00Z"}
+	text := buildCustomStatus(long, now, time.UTC).Text
+	assert.True(t, utf8.ValidString(text))
+	assert.Equal(t, customStatusMaxLength, utf8.RuneCountInString(text))
+
+	assert.True(t, isVersionAtLeast("5.36.0", customStatusMinServerVersion))
+	assert.True(t, isVersionAtLeast("6.0.1", customStatusMinServerVersion))
+	assert.False(t, isVersionAtLeast("5.16.0", customStatusMinServerVersion))
+	assert.False(t, isVersionAtLeast("5.9.10", "5.10.0"))
+}
@@ -2,19 +2,36 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jeffreylo/cronofy"
-	"github.com/mattermost/mattermost-server/model"
 	"github.com/pkg/errors"
 )
 
 const KVUserPrefix = "user_"
 const KVOAuthUserStatePrefix = "oauth_state_"
-const KVCalendarEvents = "calendar_events"
+const KVCalendarEventsPrefix = "calendar_events_"
+const KVNotificationChannelsPrefix = "notification_channels_"
+const KVUserSettingsPrefix = "settings_"
+const KVJobResultPrefix = "job_result_"
+const KVStatusChangePrefix = "status_change_"
+const KVCustomStatusPrefix = "custom_status_"
+const KVReminderSchedulePrefix = "reminders_"
+const KVAgendaSentPrefix = "agenda_sent_"
 
-func (p *Plugin) getCronofyUser(userID string) (*AccessTokenResponse, error) {
+const legacyKVCalendarEvents = "calendar_events"
+
+const storedEventRetention = 24 * time.Hour
+
+const eventStoreAttempts = 3
+
+const OAuthStateExpiry = 10 * time.Minute
+
+func (p *Plugin) getCronofyUser(userID string) (*CronofyUser, error) {
 	key := KVUserPrefix + userID
 
 	data, appErr := p.API.KVGet(key)
@@ -22,25 +39,46 @@ func (p *Plugin) getCronofyUser(userID string) (*AccessTokenResponse, error) {
 		return nil, errors.Wrap(appErr, "Failed to get user from kv store")
 	}
 
-	u := &AccessTokenResponse{}
-	err := json.Unmarshal(data, u)
-	return u, err
+	if data == nil {
+		return nil, errNotConnected
+	}
+
+	u, err := unmarshalCronofyUser(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(u.Accounts) == 0 {
+		return nil, errNotConnected
+	}
+
+	return u, nil
 }
 
-func (p *Plugin) storeCronofyUser(userID string, cronofyUser *AccessTokenResponse) error {
+func (p *Plugin) storeCronofyUser(userID string, cronofyUser *CronofyUser) error {
 	key := KVUserPrefix + userID
 	data, appErr := json.Marshal(cronofyUser)
 	if appErr != nil {
 		return errors.Wrap(appErr, "Failed to store user in kv store")
 	}
 
-	return p.API.KVSet(key, data)
+	kvErr := p.API.KVSet(key, data)
+	if kvErr != nil {
+		return errors.Wrap(kvErr, "Failed to store user in kv store")
+	}
+
+	return nil
 }
 
 func (p *Plugin) storeOAuthUserState(userID string, state []byte) error {
 	key := KVOAuthUserStatePrefix + userID
 
-	return p.API.KVSet(key, state)
+	appErr := p.API.KVSetWithExpiry(key, state, int64(OAuthStateExpiry/time.Second))
+	if appErr != nil {
+		return errors.Wrap(appErr, "Failed to store OAuth state in kv store")
+	}
+
+	return nil
 }
 
 func (p *Plugin) getOAuthUserState(userID string) ([]byte, error) {
@@ -54,10 +92,31 @@ func (p *Plugin) getOAuthUserState(userID string) ([]byte, error) {
 	return data, nil
 }
 
+// consumeOAuthUserState deletes the state atomically, so it can only be used once.
+func (p *Plugin) consumeOAuthUserState(userID string, providedState []byte) (bool, error) {
+	key := KVOAuthUserStatePrefix + userID
+
+	storedState, err := p.getOAuthUserState(userID)
+	if err != nil {
+		return false, err
+	}
+
+	if len(storedState) == 0 || subtle.ConstantTimeCompare(storedState, providedState) != 1 {
+		return false, nil
+	}
+
+	deleted, appErr := p.API.KVCompareAndDelete(key, storedState)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "Failed to delete OAuth state from kv store")
+	}
+
+	return deleted, nil
+}
+
 type CalendarEventStore map[string]cronofy.Event
 
-func (p *Plugin) getEvent(event_uid string) (*cronofy.Event, error) {
-	allEvents, err := p.getEvents()
+func (p *Plugin) getEvent(userID, event_uid string) (*cronofy.Event, error) {
+	allEvents, err := p.getEvents(userID)
 	if err != nil {
 		return nil, err
 	}
@@ -70,46 +129,357 @@ func (p *Plugin) getEvent(event_uid string) (*cronofy.Event, error) {
 	return nil, errors.New("Failed to get event from kv store")
 }
 
-func (p *Plugin) getEvents() (map[string]cronofy.Event, error) {
-	key := KVCalendarEvents
+func (p *Plugin) getEvents(userID string) (map[string]cronofy.Event, error) {
+	_, allEvents, err := p.getEventsData(userID)
+	return allEvents, err
+}
 
-	var data []byte
-	var appErr *model.AppError
+// getEventsData also returns the raw data for compare-and-set.
+func (p *Plugin) getEventsData(userID string) ([]byte, map[string]cronofy.Event, error) {
+	key := KVCalendarEventsPrefix + userID
 
-	data, appErr = p.API.KVGet(key)
+	data, appErr := p.API.KVGet(key)
 	if appErr != nil {
-		return nil, errors.Wrap(appErr, "KVGET failed")
+		return nil, nil, errors.Wrap(appErr, "Failed to get events from kv store")
 	}
 
 	allEvents := map[string]cronofy.Event{}
 	if data == nil {
-		return allEvents, nil
+		return nil, allEvents, nil
 	}
 
 	err := json.Unmarshal(data, &allEvents)
-	return allEvents, err
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, allEvents, nil
+}
+
+// storeEvents merges with compare-and-set, so events stored concurrently aren't lost.
+func (p *Plugin) storeEvents(userID string, events []*cronofy.Event) error {
+	key := KVCalendarEventsPrefix + userID
+
+	for i := 0; i < eventStoreAttempts; i++ {
+		previous, allEvents, err := p.getEventsData(userID)
+		if err != nil {
+			return err
+		}
+
+		for _, evt := range events {
+			if isEventRemoved(evt) {
+				delete(allEvents, evt.EventUID)
+				continue
+			}
+			allEvents[evt.EventUID] = *evt
+		}
+		pruneEvents(allEvents, time.Now())
+
+		value, err := json.Marshal(allEvents)
+		if err != nil {
+			return errors.Wrap(err, "Failed to store events in kv store")
+		}
+
+		stored, appErr := p.API.KVCompareAndSet(key, previous, value)
+		if appErr != nil {
+			return errors.Wrap(appErr, "Failed to store events in kv store")
+		}
+
+		if stored {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Stored events were changed concurrently %d times", eventStoreAttempts)
+}
+
+func pruneEvents(allEvents map[string]cronofy.Event, now time.Time) {
+	for uid, evt := range allEvents {
+		_, end, _, err := getEventTimes(&evt, time.UTC)
+		if err == nil && end.Add(storedEventRetention).Before(now) {
+			delete(allEvents, uid)
+		}
+	}
+}
+
+func (p *Plugin) getUserSettings(userID string) (*UserSettings, error) {
+	key := KVUserSettingsPrefix + userID
+
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "Failed to get user settings from kv store")
+	}
+
+	settings := &UserSettings{}
+	if data == nil {
+		return settings, nil
+	}
+
+	err := json.Unmarshal(data, settings)
+	return settings, err
+}
+
+func (p *Plugin) storeUserSettings(userID string, settings *UserSettings) error {
+	key := KVUserSettingsPrefix + userID
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return errors.Wrap(err, "Failed to store user settings in kv store")
+	}
+
+	appErr := p.API.KVSet(key, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Failed to store user settings in kv store")
+	}
+
+	return nil
+}
+
+type JobResult struct {
+	RanAt  time.Time `json:"ran_at"`
+	Result string    `json:"result"`
+	Error  string    `json:"error"`
+}
+
+func (p *Plugin) storeJobResult(userID string, result *JobResult) error {
+	key := KVJobResultPrefix + userID
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errors.Wrap(err, "Failed to store job result in kv store")
+	}
+
+	appErr := p.API.KVSet(key, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Failed to store job result in kv store")
+	}
+
+	return nil
+}
+
+func (p *Plugin) getStatusChange(userID string) (*StatusChange, error) {
+	key := KVStatusChangePrefix + userID
+
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "Failed to get status change from kv store")
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	change := &StatusChange{}
+	err := json.Unmarshal(data, change)
+	return change, err
 }
 
-func (p *Plugin) storeEvents(events []*cronofy.Event) error {
-	key := KVCalendarEvents
+func (p *Plugin) storeStatusChange(userID string, change *StatusChange) error {
+	key := KVStatusChangePrefix + userID
 
-	allEvents, err := p.getEvents()
+	data, err := json.Marshal(change)
 	if err != nil {
-		return errors.WithMessage(err, "1")
+		return errors.Wrap(err, "Failed to store status change in kv store")
 	}
 
-	for _, evt := range events {
-		allEvents[evt.EventUID] = *evt
+	appErr := p.API.KVSet(key, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Failed to store status change in kv store")
+	}
+
+	return nil
+}
+
+func (p *Plugin) deleteStatusChange(userID string) error {
+	appErr := p.API.KVDelete(KVStatusChangePrefix + userID)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Failed to delete status change from kv store")
+	}
+
+	return nil
+}
+
+func (p *Plugin) getCustomStatus(userID string) (string, error) {
+	data, appErr := p.API.KVGet(KVCustomStatusPrefix + userID)
+	if appErr != nil {
+		return "", errors.Wrap(appErr, "Failed to get custom status from kv store")
+	}
+
+	return string(data), nil
+}
+
+func (p *Plugin) storeCustomStatus(userID, customStatus string) error {
+	appErr := p.API.KVSet(KVCustomStatusPrefix+userID, []byte(customStatus))
+	if appErr != nil {
+		return errors.Wrap(appErr, "Failed to store custom status in kv store")
+	}
+
+	return nil
+}
+
+func (p *Plugin) deleteCustomStatus(userID string) error {
+	appErr := p.API.KVDelete(KVCustomStatusPrefix + userID)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Failed to delete custom status from kv store")
 	}
 
-	value, err := json.Marshal(allEvents)
+	return nil
+}
+
+// getReminderSchedule also returns the raw data for compareAndStoreReminderSchedule.
+func (p *Plugin) getReminderSchedule(userID string) ([]byte, *ReminderSchedule, error) {
+	key := KVReminderSchedulePrefix + userID
+
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "Failed to get reminder schedule from kv store")
+	}
+
+	schedule := newReminderSchedule()
+	if data == nil {
+		return nil, schedule, nil
+	}
+
+	err := json.Unmarshal(data, schedule)
 	if err != nil {
-		return errors.WithMessage(err, "2")
+		return nil, nil, err
 	}
 
-	appErr := p.API.KVSet(key, value)
+	if schedule.Conferencing == nil {
+		schedule.Conferencing = map[string]*Conferencing{}
+	}
+	if schedule.Sent == nil {
+		schedule.Sent = map[string]string{}
+	}
+
+	return data, schedule, nil
+}
+
+func (p *Plugin) compareAndStoreReminderSchedule(userID string, previous []byte, schedule *ReminderSchedule) (bool, error) {
+	key := KVReminderSchedulePrefix + userID
+
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to store reminder schedule in kv store")
+	}
+
+	stored, appErr := p.API.KVCompareAndSet(key, previous, data)
 	if appErr != nil {
-		return errors.Wrap(appErr, "KVSET failed")
+		return false, errors.Wrap(appErr, "Failed to store reminder schedule in kv store")
+	}
+
+	return stored, nil
+}
+
+func (p *Plugin) getAgendaSentDate(userID string) (string, error) {
+	data, appErr := p.API.KVGet(KVAgendaSentPrefix + userID)
+	if appErr != nil {
+		return "", errors.Wrap(appErr, "Failed to get agenda date from kv store")
+	}
+
+	return string(data), nil
+}
+
+func (p *Plugin) compareAndStoreAgendaSentDate(userID, previous, date string) (bool, error) {
+	var old []byte
+	if previous != "" {
+		old = []byte(previous)
+	}
+
+	stored, appErr := p.API.KVCompareAndSet(KVAgendaSentPrefix+userID, old, []byte(date))
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "Failed to store agenda date in kv store")
+	}
+
+	return stored, nil
+}
+
+func (p *Plugin) getUserNotificationChannels(userID string) (map[string]NotificationChannel, error) {
+	key := KVNotificationChannelsPrefix + userID
+
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "Failed to get notification channels from kv store")
+	}
+
+	channels := map[string]NotificationChannel{}
+	if data == nil {
+		return channels, nil
+	}
+
+	err := json.Unmarshal(data, &channels)
+	return channels, err
+}
+
+func (p *Plugin) storeUserNotificationChannels(userID string, channels map[string]NotificationChannel) error {
+	key := KVNotificationChannelsPrefix + userID
+
+	data, err := json.Marshal(channels)
+	if err != nil {
+		return errors.Wrap(err, "Failed to store notification channels in kv store")
+	}
+
+	appErr := p.API.KVSet(key, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Failed to store notification channels in kv store")
+	}
+
+	return nil
+}
+
+func (p *Plugin) listConnectedUserIDs() ([]string, error) {
+	const perPage = 100
+
+	userIDs := []string{}
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, perPage)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "Failed to list keys in kv store")
+		}
+
+		for _, key := range keys {
+			if strings.HasPrefix(key, KVUserPrefix) {
+				userIDs = append(userIDs, strings.TrimPrefix(key, KVUserPrefix))
+			}
+		}
+
+		if len(keys) < perPage {
+			return userIDs, nil
+		}
+	}
+}
+
+var userKVPrefixes = []string{
+	KVUserPrefix,
+	KVOAuthUserStatePrefix,
+	KVCalendarEventsPrefix,
+	KVNotificationChannelsPrefix,
+	KVUserSettingsPrefix,
+	KVJobResultPrefix,
+	KVStatusChangePrefix,
+	KVCustomStatusPrefix,
+	KVReminderSchedulePrefix,
+	KVAgendaSentPrefix,
+}
+
+func (p *Plugin) deleteUserData(userID string) error {
+	for _, prefix := range userKVPrefixes {
+		appErr := p.API.KVDelete(prefix + userID)
+		if appErr != nil {
+			return errors.Wrapf(appErr, "Failed to delete %s from kv store", prefix+userID)
+		}
+	}
+
+	return nil
+}
+
+// deleteLegacyData drops shared values which can't be attributed to a user.
+func (p *Plugin) deleteLegacyData() error {
+	for _, key := range []string{legacyKVCalendarEvents, legacyKVNotificationChannel} {
+		appErr := p.API.KVDelete(key)
+		if appErr != nil {
+			return errors.Wrapf(appErr, "Failed to delete %s from kv store", key)
+		}
 	}
 
 	return nil
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const KVNotificationCallbackHash = "notification_callback_hash"
+
+const KVNotificationRepairLock = "notification_repair_lock"
+
+const notificationRepairLockTTL = 5 * time.Minute
+
+const legacyKVNotificationChannel = "cronofy_notification_channel"
+
+// syncNotificationChannel closes duplicate and stale channels, keeping one for the current URL.
+func syncNotificationChannel(h IHandler, userID string, ac *AccountClient) (*NotificationChannel, error) {
+	p := h.GetPlugin()
+
+	channels, err := getNotificationChannels(ac.Client, userID)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list notification channels")
+	}
+
+	callbackURL := getNotificationCallbackURL(p, userID, ac.Account.AccountId)
+
+	var current *NotificationChannel
+	for i, channel := range channels {
+		if current == nil && channel.CallbackUrl == callbackURL {
+			current = &channels[i]
+			continue
+		}
+
+		err = closeNotificationChannel(ac.Client, userID, channel.ChannelId)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to close notification channel")
+		}
+	}
+
+	if current != nil {
+		return current, nil
+	}
+
+	current, err = createNotificationChannel(h, userID, ac)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create notification channel")
+	}
+
+	return current, nil
+}
+
+func syncUserNotificationChannels(h IHandler, userID string) error {
+	p := h.GetPlugin()
+
+	clients, err := h.MakeUserCronofyClients(userID)
+	if err != nil {
+		return err
+	}
+
+	channels := map[string]NotificationChannel{}
+	errs := []string{}
+	for _, ac := range clients {
+		channel, err := syncNotificationChannel(h, userID, ac)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", ac.Account.describeProfiles(), err.Error()))
+			continue
+		}
+		channels[ac.Account.AccountId] = *channel
+	}
+
+	err = p.storeUserNotificationChannels(userID, channels)
+	if err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to sync notification channels. %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func closeUserNotificationChannel(h IHandler, userID, channelID string) (int, error) {
+	p := h.GetPlugin()
+
+	clients, err := h.MakeUserCronofyClients(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	stored, err := p.getUserNotificationChannels(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	closed := 0
+	for _, ac := range clients {
+		channels, err := getNotificationChannels(ac.Client, userID)
+		if err != nil {
+			return closed, err
+		}
+
+		for _, channel := range channels {
+			if channelID != "" && channel.ChannelId != channelID {
+				continue
+			}
+
+			err = closeNotificationChannel(ac.Client, userID, channel.ChannelId)
+			if err != nil {
+				return closed, err
+			}
+			closed++
+
+			if stored[ac.Account.AccountId].ChannelId == channel.ChannelId {
+				delete(stored, ac.Account.AccountId)
+			}
+		}
+	}
+
+	return closed, p.storeUserNotificationChannels(userID, stored)
+}
+
+// checkNotificationChannels recreates channels when the callback URL changes, on one node only.
+func (p *Plugin) checkNotificationChannels() {
+	hash := []byte(hashkey("", getNotificationCallbackURL(p, "", "")))
+
+	stored, appErr := p.API.KVGet(KVNotificationCallbackHash)
+	if appErr != nil {
+		p.API.LogError("Failed to get notification callback hash", "error", appErr.Error())
+		return
+	}
+
+	if string(stored) == string(hash) {
+		return
+	}
+
+	go func() {
+		nodeID := model.NewId()
+		if !p.acquireClusterLock(KVNotificationRepairLock, nodeID, notificationRepairLockTTL) {
+			return
+		}
+		defer p.releaseClusterLock(KVNotificationRepairLock, nodeID)
+
+		// Another node may have finished the repair while this one was waiting for the lock.
+		stored, appErr := p.API.KVGet(KVNotificationCallbackHash)
+		if appErr != nil || string(stored) == string(hash) {
+			return
+		}
+
+		err := p.repairNotificationChannels(nodeID)
+		if err != nil {
+			p.API.LogError("Failed to repair notification channels", "error", err.Error())
+			return
+		}
+
+		_ = p.API.KVSet(KVNotificationCallbackHash, hash)
+	}()
+}
+
+func (p *Plugin) repairNotificationChannels(nodeID string) error {
+	h := &Handler{plugin: p}
+
+	userIDs, err := p.listConnectedUserIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if !p.acquireClusterLock(KVNotificationRepairLock, nodeID, notificationRepairLockTTL) {
+			return errors.New("lost the notification channel repair lock")
+		}
+
+		err = syncUserNotificationChannels(h, userID)
+		if err != nil {
+			p.API.LogWarn("Failed to repair notification channels for user", "user_id", userID, "error", err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+type EventChangeType string
+
+const (
+	EventChangeNewInvite        EventChangeType = "new_invite"
+	EventChangeNewEvent         EventChangeType = "new_event"
+	EventChangeRescheduled      EventChangeType = "rescheduled"
+	EventChangeLocationChanged  EventChangeType = "location_changed"
+	EventChangeAttendeesChanged EventChangeType = "attendees_changed"
+	EventChangeCancelled        EventChangeType = "cancelled"
+	EventChangeDeleted          EventChangeType = "deleted"
+)
+
+var eventChangeTypes = []EventChangeType{
+	EventChangeNewInvite,
+	EventChangeNewEvent,
+	EventChangeRescheduled,
+	EventChangeLocationChanged,
+	EventChangeAttendeesChanged,
+	EventChangeCancelled,
+	EventChangeDeleted,
+}
+
+type EventChange struct {
+	Event     *cronofy.Event
+	Previous  *cronofy.Event
+	Types     []EventChangeType
+	Details   []string
+	Conflicts []*cronofy.Event
+}
+
+// diffEvents leaves out events with no notable differences, such as the user's own replies.
+func diffEvents(previous map[string]cronofy.Event, events []*cronofy.Event, loc *time.Location) []*EventChange {
+	changes := []*EventChange{}
+	for _, evt := range events {
+		var change *EventChange
+		prev, exists := previous[evt.EventUID]
+		if exists {
+			change = diffEvent(&prev, evt, loc)
+		} else {
+			change = diffNewEvent(evt, loc)
+		}
+
+		if change != nil {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes
+}
+
+func diffNewEvent(evt *cronofy.Event, loc *time.Location) *EventChange {
+	change := &EventChange{Event: evt}
+
+	switch {
+	case evt.Deleted:
+		// An event we never saw was created and deleted in between notifications.
+		return nil
+	case evt.Status == "cancelled":
+		change.Types = append(change.Types, EventChangeCancelled)
+		change.Details = cancellationDetails(evt, evt, loc)
+	case evt.ParticipationStatus == "needs_action":
+		change.Types = append(change.Types, EventChangeNewInvite)
+	default:
+		change.Types = append(change.Types, EventChangeNewEvent)
+	}
+
+	return change
+}
+
+func diffEvent(prev, evt *cronofy.Event, loc *time.Location) *EventChange {
+	change := &EventChange{Event: evt, Previous: prev}
+
+	if evt.Deleted {
+		change.Types = append(change.Types, EventChangeDeleted)
+		change.Details = cancellationDetails(prev, evt, loc)
+		return change
+	}
+
+	if evt.Status == "cancelled" {
+		change.Types = append(change.Types, EventChangeCancelled)
+		change.Details = cancellationDetails(prev, evt, loc)
+		return change
+	}
+
+	if prev.Start != evt.Start || prev.End != evt.End {
+		change.Types = append(change.Types, EventChangeRescheduled)
+		change.Details = append(change.Details, fmt.Sprintf("Time: %s → %s", formatEventTimeRange(prev, loc), formatEventTimeRange(evt, loc)))
+	}
+
+	if prev.Location() != evt.Location() {
+		change.Types = append(change.Types, EventChangeLocationChanged)
+		change.Details = append(change.Details, fmt.Sprintf("Location: %s → %s", formatLocation(prev), formatLocation(evt)))
+	}
+
+	added, removed := diffAttendees(prev, evt)
+	if len(added) > 0 || len(removed) > 0 {
+		change.Types = append(change.Types, EventChangeAttendeesChanged)
+		if len(added) > 0 {
+			change.Details = append(change.Details, "Attendees added: "+strings.Join(added, ", "))
+		}
+		if len(removed) > 0 {
+			change.Details = append(change.Details, "Attendees removed: "+strings.Join(removed, ", "))
+		}
+	}
+
+	if len(change.Types) == 0 {
+		return nil
+	}
+
+	return change
+}
+
+func isEventRemoved(evt *cronofy.Event) bool {
+	return evt.Deleted || evt.Status == "cancelled"
+}
+
+// cancellationDetails prefers the previous snapshot, as deleted events come back with few details.
+func cancellationDetails(prev, evt *cronofy.Event, loc *time.Location) []string {
+	details := []string{fmt.Sprintf("Was scheduled for: %s", formatEventTimeRange(prev, loc))}
+
+	organizer := formatPerson(evt.Organizer.DisplayName, evt.Organizer.Email)
+	if organizer == "" {
+		organizer = formatPerson(prev.Organizer.DisplayName, prev.Organizer.Email)
+	}
+	if organizer != "" {
+		details = append(details, fmt.Sprintf("Cancelled by: %s", organizer))
+	}
+
+	return details
+}
+
+func formatPerson(displayName, email string) string {
+	if displayName == "" {
+		return email
+	}
+	if email == "" {
+		return displayName
+	}
+
+	return fmt.Sprintf("%s (%s)", displayName, email)
+}
+
+func diffAttendees(prev, evt *cronofy.Event) (added, removed []string) {
+	prevEmails := map[string]bool{}
+	for _, a := range prev.Attendees {
+		prevEmails[a.Email] = true
+	}
+
+	emails := map[string]bool{}
+	for _, a := range evt.Attendees {
+		emails[a.Email] = true
+		if !prevEmails[a.Email] {
+			added = append(added, a.Email)
+		}
+	}
+
+	for _, a := range prev.Attendees {
+		if !emails[a.Email] {
+			removed = append(removed, a.Email)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func formatEventTimeRange(evt *cronofy.Event, loc *time.Location) string {
+	start, end, allDay, err := getEventTimes(evt, loc)
+	if err != nil {
+		return evt.Start
+	}
+
+	days := eventDays(start, end)
+	switch {
+	case allDay && len(days) == 1:
+		return fmt.Sprintf("%s (all day)", start.Format(DEFAULT_DATE_FORMAT))
+	case allDay:
+		return fmt.Sprintf("%s - %s (all day)", start.Format(DEFAULT_DATE_FORMAT), days[len(days)-1].Format(DEFAULT_DATE_FORMAT))
+	case len(days) > 1:
+		return fmt.Sprintf("%s - %s", start.Format(DEFAULT_DATETIME_FORMAT), end.Format(DEFAULT_DATETIME_FORMAT))
+	}
+
+	return fmt.Sprintf("%s - %s", start.Format(DEFAULT_DATETIME_FORMAT), end.Format(DEFAULT_TIME_FORMAT))
+}
+
+func formatLocation(evt *cronofy.Event) string {
+	location := evt.Location()
+	if location == "" {
+		return "(none)"
+	}
+
+	return location
+}
+
+var eventChangeTitles = map[EventChangeType]string{
+	EventChangeNewInvite:        "New invite",
+	EventChangeNewEvent:         "New event",
+	EventChangeRescheduled:      "Rescheduled",
+	EventChangeLocationChanged:  "Location changed",
+	EventChangeAttendeesChanged: "Attendees changed",
+	EventChangeCancelled:        "Cancelled",
+	EventChangeDeleted:          "Deleted",
+}
+
+func formatEventChanges(changes []*EventChange, loc *time.Location) string {
+	rows := []string{"#### Calendar updates\n"}
+	for _, change := range changes {
+		evt := change.Event
+		summary := evt.Summary
+		if summary == "" && change.Previous != nil {
+			summary = change.Previous.Summary
+		}
+
+		titles := []string{}
+		for _, t := range change.Types {
+			titles = append(titles, eventChangeTitles[t])
+		}
+
+		if isEventRemoved(evt) {
+			rows = append(rows, fmt.Sprintf("* **%s**: \"%s\"", strings.Join(titles, ", "), summary))
+		} else {
+			rows = append(rows, fmt.Sprintf("* **%s**: \"%s\" %s", strings.Join(titles, ", "), summary, formatEventTimeRange(evt, loc)))
+		}
+		for _, detail := range change.Details {
+			rows = append(rows, fmt.Sprintf("    * %s", detail))
+		}
+	}
+
+	return strings.Join(rows, "\n")
+}
+
+func getEventChangeAttachments(changes []*EventChange) []*model.SlackAttachment {
+	attachments := []*model.SlackAttachment{}
+	for _, change := range changes {
+		evt := change.Event
+		if isEventRemoved(evt) {
+			continue
+		}
+
+		switch {
+		case evt.ParticipationStatus == "needs_action":
+			attachment := getParticipationAttachment(evt)
+			if len(change.Conflicts) > 0 {
+				addConflicts(attachment, evt, change.Conflicts)
+			}
+			attachments = append(attachments, attachment)
+		case len(change.Conflicts) > 0:
+			attachments = append(attachments, getConflictAttachment(evt, change.Conflicts))
+		}
+	}
+
+	return attachments
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffEvents(t *testing.T) {
+	makeEvent := func(uid, start string) cronofy.Event {
+		evt := cronofy.Event{
+			EventUID:            uid,
+			Summary:             "Standup",
+			Start:               start,
+			End:                 "2019-11-25T19:45:00Z",
+			Status:              "confirmed",
+			ParticipationStatus: "accepted",
+		}
+		evt.Loc.Description = "Room 1"
+		evt.Organizer.DisplayName = "Organizer"
+		evt.Organizer.Email = "organizer@example.com"
+		return evt
+	}
+
+	previous := map[string]cronofy.Event{
+		"unchanged":   makeEvent("unchanged", "2019-11-25T19:00:00Z"),
+		"rescheduled": makeEvent("rescheduled", "2019-11-25T19:00:00Z"),
+		"moved":       makeEvent("moved", "2019-11-25T19:00:00Z"),
+		"deleted":     makeEvent("deleted", "2019-11-25T19:00:00Z"),
+	}
+
+	unchanged := makeEvent("unchanged", "2019-11-25T19:00:00Z")
+	rescheduled := makeEvent("rescheduled", "2019-11-25T19:15:00Z")
+	moved := makeEvent("moved", "2019-11-25T19:00:00Z")
+	moved.Loc.Description = "Room 2"
+	deleted := makeEvent("deleted", "2019-11-25T19:00:00Z")
+	deleted.Deleted = true
+	invite := makeEvent("invite", "2019-11-25T19:00:00Z")
+	invite.ParticipationStatus = "needs_action"
+
+	changes := diffEvents(previous, []*cronofy.Event{&unchanged, &rescheduled, &moved, &deleted, &invite}, time.UTC)
+	require.Len(t, changes, 4)
+
+	assert.Equal(t, []EventChangeType{EventChangeRescheduled}, changes[0].Types)
+	assert.Equal(t, []EventChangeType{EventChangeLocationChanged}, changes[1].Types)
+	assert.Equal(t, []string{"Location: Room 1 → Room 2"}, changes[1].Details)
+	assert.Equal(t, []EventChangeType{EventChangeDeleted}, changes[2].Types)
+	assert.Equal(t, []string{"Was scheduled for: Monday November 25 7:00 PM - 7:45 PM", "Cancelled by: Organizer (organizer@example.com)"}, changes[2].Details)
+	assert.Equal(t, []EventChangeType{EventChangeNewInvite}, changes[3].Types)
+}
+
+func TestStoreEvents(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api)
+
+	now := time.Now().UTC()
+	makeEvent := func(uid string, end time.Time) *cronofy.Event {
+		return &cronofy.Event{
+			EventUID: uid,
+			Start:    end.Add(-time.Hour).Format(CRONOFY_DATETIME_FORMAT),
+			End:      end.Format(CRONOFY_DATETIME_FORMAT),
+		}
+	}
+
+	err := p.storeEvents("user1", []*cronofy.Event{
+		makeEvent("old", now.Add(-storedEventRetention-time.Hour)),
+		makeEvent("recent", now.Add(-time.Hour)),
+	})
+	require.Nil(t, err)
+
+	removed := makeEvent("recent", now.Add(-time.Hour))
+	removed.Deleted = true
+	err = p.storeEvents("user1", []*cronofy.Event{removed, makeEvent("upcoming", now.Add(time.Hour))})
+	require.Nil(t, err)
+
+	events, err := p.getEvents("user1")
+	require.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Contains(t, events, "upcoming")
+}
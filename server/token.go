@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const tokenRefreshLeeway = 5 * time.Minute
+
+var errInvalidGrant = errors.New("the OAuth grant is invalid or has been revoked")
+
+type TokenManager struct {
+	plugin *Plugin
+
+	// lock stops concurrent requests each spending the refresh token.
+	lock sync.Mutex
+}
+
+func newTokenManager(p *Plugin) *TokenManager {
+	return &TokenManager{plugin: p}
+}
+
+// GetCronofyUser returns accounts which fail to refresh as they are, to retry on a 401.
+func (tm *TokenManager) GetCronofyUser(userID string) (*CronofyUser, error) {
+	cronofyUser, err := tm.plugin.getCronofyUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i, account := range cronofyUser.Accounts {
+		if !account.needsRefresh(now) {
+			continue
+		}
+
+		refreshed, err := tm.Refresh(userID, account.AccountId, account.AccessToken)
+		if err != nil {
+			tm.plugin.API.LogWarn("Failed to refresh Cronofy access token", "user_id", userID, "account_id", account.AccountId, "error", err.Error())
+			continue
+		}
+		cronofyUser.Accounts[i] = refreshed
+	}
+
+	return cronofyUser, nil
+}
+
+// Refresh does nothing if the stored token has been replaced since rejectedToken was read.
+func (tm *TokenManager) Refresh(userID, accountID, rejectedToken string) (*CronofyAccount, error) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	p := tm.plugin
+
+	cronofyUser, err := p.getCronofyUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	account := cronofyUser.getAccount(accountID)
+	if account == nil {
+		return nil, errors.New("account is no longer linked")
+	}
+
+	if account.AccessToken != rejectedToken {
+		return account, nil
+	}
+
+	if account.RefreshToken == "" {
+		return nil, errors.New("no refresh token stored for account")
+	}
+
+	res, err := refreshAccessToken(p, account.RefreshToken)
+	if err == errInvalidGrant {
+		_, _ = p.CreateBotDMtoMMUserId(userID, "Your calendar connection for %s has expired or was revoked. Please run `/cronofy connect` to reconnect your calendar.", account.describeProfiles())
+		return nil, errors.Wrap(err, "failed to refresh access token")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to refresh access token")
+	}
+
+	account.AccessToken = res.AccessToken
+	if res.RefreshToken != "" {
+		account.RefreshToken = res.RefreshToken
+	}
+	account.ExpiresIn = res.ExpiresIn
+	account.setExpiry(time.Now())
+
+	err = p.storeCronofyUser(userID, cronofyUser)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to store refreshed access token")
+	}
+
+	return account, nil
+}
+
+// needsRefresh leaves tokens stored without an expiry to be refreshed on a 401.
+func (res *AccessTokenResponse) needsRefresh(now time.Time) bool {
+	if res.ExpiresAt.IsZero() || res.RefreshToken == "" {
+		return false
+	}
+
+	return now.Add(tokenRefreshLeeway).After(res.ExpiresAt)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/rand"
 	b64 "encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"sort"
 	"strings"
@@ -13,13 +15,20 @@ import (
 )
 
 func getRandomHash() ([]byte, error) {
-	return []byte("random hash"), nil
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(hex.EncodeToString(b)), nil
 }
 
 const DEFAULT_DATE_FORMAT = "Monday January 02"
 const DEFAULT_DATETIME_FORMAT = "Monday January 02 3:04 PM"
 const DEFAULT_TIME_FORMAT = "3:04 PM"
 const CRONOFY_DATETIME_FORMAT = "2006-01-02T15:04:05Z"
+const CRONOFY_DATE_FORMAT = "2006-01-02"
 
 const GOOGLE_IMAGE_URL = "https://collegeinfogeek.com/wp-content/uploads/2016/08/Google_Calendar_Logo.png"
 const OUTLOOK_IMAGE_URL = "https://images.techhive.com/images/article/2014/09/outlook-logo-100457446-large.jpg"
@@ -114,6 +123,34 @@ func (p *Plugin) CreateBotDMtoMMUserId(mattermostUserID, format string, args ...
 	return post, nil
 }
 
+func (p *Plugin) CreateBotDMWithAttachments(mattermostUserID, message string, attachments []*model.SlackAttachment) (post *model.Post, returnErr error) {
+	defer func() {
+		if returnErr != nil {
+			returnErr = errors.WithMessage(returnErr,
+				fmt.Sprintf("failed to create DMError to user %v: ", mattermostUserID))
+		}
+	}()
+
+	channel, appErr := p.API.GetDirectChannel(mattermostUserID, p.botUserID)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	post = &model.Post{
+		UserId:    p.botUserID,
+		ChannelId: channel.Id,
+		Message:   message,
+	}
+	model.ParseSlackAttachment(post, attachments)
+
+	_, appErr = p.API.CreatePost(post)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	return post, nil
+}
+
 /*
 
 const DEFAULT_USER_ID = "t88abq1sipbbxmhijgw431gc9c"
@@ -132,50 +169,233 @@ func (p *Plugin) ephemeral(text string) {
 
 */
 
-func prettyPrintEventList(events []*cronofy.Event) string {
-	var currentDay string
+func parseEventTime(value string, loc *time.Location) (t time.Time, allDay bool, err error) {
+	t, err = time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t.In(loc), false, nil
+	}
+
+	t, err = time.ParseInLocation(CRONOFY_DATE_FORMAT, value, loc)
+	if err != nil {
+		return time.Time{}, false, errors.Errorf("invalid event time %s", value)
+	}
+
+	return t, true, nil
+}
+
+// getEventTimes ends all-day events at midnight after their last day.
+func getEventTimes(evt *cronofy.Event, loc *time.Location) (start, end time.Time, allDay bool, err error) {
+	start, allDay, err = parseEventTime(evt.Start, loc)
+	if err != nil {
+		return start, end, false, err
+	}
+
+	end, _, err = parseEventTime(evt.End, loc)
+	if err != nil {
+		return start, end, false, err
+	}
+
+	return start, end, allDay, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func eventDays(start, end time.Time) []time.Time {
+	days := []time.Time{startOfDay(start)}
+	for day := days[0].AddDate(0, 0, 1); day.Before(end); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+
+	return days
+}
+
+type eventListDay struct {
+	Day time.Time
+
+	// AllDay also holds the events spanning several days.
+	AllDay []*cronofy.Event
+	Timed  []*cronofy.Event
+}
+
+func groupEventsByDay(events []*cronofy.Event, from, to time.Time, loc *time.Location) []*eventListDay {
+	firstDay := startOfDay(from.In(loc))
+	lastDay := startOfDay(to.In(loc))
+
+	byDay := map[time.Time]*eventListDay{}
+	getDay := func(day time.Time) *eventListDay {
+		entry, ok := byDay[day]
+		if !ok {
+			entry = &eventListDay{Day: day}
+			byDay[day] = entry
+		}
+		return entry
+	}
 
-	rows := []string{}
 	for _, event := range events {
-		start, _ := time.Parse(CRONOFY_DATETIME_FORMAT, event.Start)
-		dateStr := start.Format(DEFAULT_DATE_FORMAT)
-		if currentDay != dateStr {
-			currentDay = dateStr
-			rows = append(rows, fmt.Sprintf("\n##### %s\n\n", dateStr))
+		start, end, allDay, err := getEventTimes(event, loc)
+		if err != nil {
+			continue
+		}
+
+		days := eventDays(start, end)
+		for _, day := range days {
+			if day.Before(firstDay) || !day.Before(lastDay) {
+				continue
+			}
+
+			if allDay || len(days) > 1 {
+				getDay(day).AllDay = append(getDay(day).AllDay, event)
+			} else {
+				getDay(day).Timed = append(getDay(day).Timed, event)
+			}
 		}
+	}
+
+	result := []*eventListDay{}
+	for _, entry := range byDay {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Day.Before(result[j].Day)
+	})
 
-		name := event.Summary
+	return result
+}
+
+func formatAllDayLabel(event *cronofy.Event, day time.Time, loc *time.Location) string {
+	start, end, allDay, _ := getEventTimes(event, loc)
+	days := eventDays(start, end)
+	if len(days) == 1 {
+		return "All day"
+	}
 
-		bullets := []string{}
-		if event.ParticipationStatus == "needs_action" {
-			bullets = append(bullets, getParticipationLinksString(event))
+	n := 1
+	for i, d := range days {
+		if d.Equal(day) {
+			n = i + 1
 		}
+	}
 
-		startTime, _ := time.Parse(CRONOFY_DATETIME_FORMAT, event.Start)
-		startTimeStr := startTime.Format(DEFAULT_TIME_FORMAT)
-		endTime, _ := time.Parse(CRONOFY_DATETIME_FORMAT, event.End)
-		endTimeStr := endTime.Format(DEFAULT_TIME_FORMAT)
+	label := "All day"
+	if !allDay && n == 1 {
+		label = "From " + start.Format(DEFAULT_TIME_FORMAT)
+	} else if !allDay && n == len(days) {
+		label = "Until " + end.Format(DEFAULT_TIME_FORMAT)
+	}
+
+	return fmt.Sprintf("%s (day %d of %d)", label, n, len(days))
+}
+
+func getEventBullets(event *cronofy.Event) (bullets []string, participationStatus string) {
+	if event.ParticipationStatus == "needs_action" {
+		bullets = append(bullets, fmt.Sprintf("%s has invited you. Reply with the buttons in your invite message.", event.Organizer.Email))
+	}
+
+	participationStatus = event.ParticipationStatus
+	if participationStatus == "unknown" || participationStatus == "needs_action" {
+		participationStatus = ""
+	} else {
+		bullets = append(bullets, "You have replied: "+strings.Title(participationStatus))
+	}
 
-		participationStatus := event.ParticipationStatus
-		if participationStatus == "unknown" || participationStatus == "needs_action" {
-			participationStatus = ""
-		} else {
-			bullets = append(bullets, "You have replied: "+strings.Title(participationStatus))
+	return bullets, participationStatus
+}
+
+func prettyPrintEventList(events []*cronofy.Event, conflicts map[string][]*cronofy.Event, from, to time.Time, loc *time.Location) string {
+	rows := []string{}
+	for _, day := range groupEventsByDay(events, from, to, loc) {
+		rows = append(rows, fmt.Sprintf("\n##### %s\n\n", day.Day.Format(DEFAULT_DATE_FORMAT)))
+
+		for _, event := range day.AllDay {
+			bullets, participationStatus := getEventBullets(event)
+			rows = append(rows, fmt.Sprintf("* ##### %s \"%s\" %s\n", formatAllDayLabel(event, day.Day, loc), event.Summary, participationStatus))
+			for _, bullet := range bullets {
+				rows = append(rows, fmt.Sprintf("    * %s\n", bullet))
+			}
 		}
 
-		text := fmt.Sprintf("* ##### %s - %s \"%s\" %s\n", startTimeStr, endTimeStr, name, participationStatus)
-		rows = append(rows, text)
+		for _, event := range day.Timed {
+			bullets, participationStatus := getEventBullets(event)
+			start, end, _, _ := getEventTimes(event, loc)
+			startTimeStr := start.Format(DEFAULT_TIME_FORMAT)
+			endTimeStr := end.Format(DEFAULT_TIME_FORMAT)
 
-		for _, bullet := range bullets {
-			text := fmt.Sprintf("    * %s\n", bullet)
+			text := fmt.Sprintf("* ##### %s - %s \"%s\" %s\n", startTimeStr, endTimeStr, event.Summary, participationStatus)
 			rows = append(rows, text)
+
+			for _, conflict := range conflicts[event.EventUID] {
+				bullets = append(bullets, fmt.Sprintf("**Conflicts with** \"%s\", %s", conflict.Summary, formatEventTimeRange(conflict, loc)))
+			}
+
+			for _, bullet := range bullets {
+				text := fmt.Sprintf("    * %s\n", bullet)
+				rows = append(rows, text)
+			}
 		}
 	}
 
 	return strings.Join(rows, "")
 }
 
-func prettyPrintEventsResponse(calendars []*cronofy.Calendar, events *cronofy.EventsResponse) string {
+type EventOverlap struct {
+	First  *cronofy.Event
+	Second *cronofy.Event
+}
+
+func blocksTime(evt *cronofy.Event) bool {
+	return !evt.Declined() && !isEventRemoved(evt) && evt.Transparency != "transparent"
+}
+
+func findOverlappingEvents(events []*cronofy.Event, loc *time.Location) []EventOverlap {
+	type timedEvent struct {
+		Event      *cronofy.Event
+		Start, End time.Time
+	}
+
+	timed := []timedEvent{}
+	for _, evt := range events {
+		if !blocksTime(evt) {
+			continue
+		}
+
+		start, end, allDay, err := getEventTimes(evt, loc)
+		if err != nil || allDay {
+			continue
+		}
+
+		timed = append(timed, timedEvent{evt, start, end})
+	}
+
+	sort.SliceStable(timed, func(i, j int) bool {
+		return timed[i].Start.Before(timed[j].Start)
+	})
+
+	overlaps := []EventOverlap{}
+	for i, a := range timed {
+		for _, b := range timed[i+1:] {
+			if !b.Start.Before(a.End) {
+				break
+			}
+			overlaps = append(overlaps, EventOverlap{a.Event, b.Event})
+		}
+	}
+
+	return overlaps
+}
+
+func findEventConflicts(events []*cronofy.Event, loc *time.Location) map[string][]*cronofy.Event {
+	conflicts := map[string][]*cronofy.Event{}
+	for _, o := range findOverlappingEvents(events, loc) {
+		conflicts[o.First.EventUID] = append(conflicts[o.First.EventUID], o.Second)
+		conflicts[o.Second.EventUID] = append(conflicts[o.Second.EventUID], o.First)
+	}
+
+	return conflicts
+}
+
+func prettyPrintEventsResponse(calendars []*cronofy.Calendar, events *cronofy.EventsResponse, from, to time.Time, loc *time.Location) string {
 	type EventsByCalendar struct {
 		Calendar *cronofy.Calendar
 		Events   []*cronofy.Event
@@ -201,8 +421,11 @@ func prettyPrintEventsResponse(calendars []*cronofy.Calendar, events *cronofy.Ev
 		entry.Events = append(entry.Events, event)
 	}
 
+	// Conflicts are found across every calendar, though the events are listed by calendar.
+	conflicts := findEventConflicts(events.Events, loc)
+
 	rows := []string{}
-	rows = append(rows, "### Weekly Summary of Calendar Events\n\n")
+	rows = append(rows, formatViewTitle(from.In(loc), to.In(loc)))
 
 	temp := []*EventsByCalendar{}
 	for _, entry := range eventsMappedToCalendars {
@@ -230,7 +453,7 @@ func prettyPrintEventsResponse(calendars []*cronofy.Calendar, events *cronofy.Ev
 		text := fmt.Sprintf("### %s \"%s\"\n", providerName, name)
 		rows = append(rows, text)
 
-		text = prettyPrintEventList(entry.Events)
+		text = prettyPrintEventList(entry.Events, conflicts, from, to, loc)
 		rows = append(rows, text)
 
 		if i != len(eventsMappedToCalendars)-1 {
@@ -241,3 +464,31 @@ func prettyPrintEventsResponse(calendars []*cronofy.Calendar, events *cronofy.Ev
 
 	return strings.Join(rows, "")
 }
+
+// getUserLocation prefers the plugin timezone setting, then the Mattermost timezone, then UTC.
+func (p *Plugin) getUserLocation(userID string) *time.Location {
+	name := ""
+	settings, err := p.getUserSettings(userID)
+	if err == nil && settings.Timezone != "" {
+		name = settings.Timezone
+	} else {
+		user, appErr := p.API.GetUser(userID)
+		if appErr != nil {
+			p.API.LogWarn("Failed to get user timezone", "user_id", userID, "error", appErr.Error())
+			return time.UTC
+		}
+		name = model.GetPreferredTimezone(user.Timezone)
+	}
+
+	if name == "" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		p.API.LogWarn("Failed to load user timezone", "user_id", userID, "timezone", name, "error", err.Error())
+		return time.UTC
+	}
+
+	return loc
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupEventsByDay(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.Nil(t, err)
+
+	holiday := &cronofy.Event{Summary: "Holiday", Start: "2019-11-25", End: "2019-11-26"}
+	offsite := &cronofy.Event{Summary: "Offsite", Start: "2019-11-25T15:00:00Z", End: "2019-11-27T11:00:00Z"}
+	standup := &cronofy.Event{Summary: "Standup", Start: "2019-11-25T23:30:00Z", End: "2019-11-25T23:45:00Z"}
+
+	from := time.Date(2019, 11, 25, 9, 0, 0, 0, berlin)
+	days := groupEventsByDay([]*cronofy.Event{holiday, offsite, standup}, from, from.AddDate(0, 0, 7), berlin)
+	require.Len(t, days, 3)
+
+	assert.Equal(t, []*cronofy.Event{holiday, offsite}, days[0].AllDay)
+	assert.Empty(t, days[0].Timed)
+
+	// The standup is after midnight in Berlin.
+	assert.Equal(t, []*cronofy.Event{offsite}, days[1].AllDay)
+	assert.Equal(t, []*cronofy.Event{standup}, days[1].Timed)
+
+	assert.Equal(t, "All day", formatAllDayLabel(holiday, days[0].Day, berlin))
+	assert.Equal(t, "From 4:00 PM (day 1 of 3)", formatAllDayLabel(offsite, days[0].Day, berlin))
+	assert.Equal(t, "Until 12:00 PM (day 3 of 3)", formatAllDayLabel(offsite, days[2].Day, berlin))
+
+	assert.Equal(t, "Monday November 25 (all day)", formatEventTimeRange(holiday, berlin))
+	assert.NotContains(t, prettyPrintEventList([]*cronofy.Event{holiday}, nil, from, from.AddDate(0, 0, 7), berlin), "January 01")
+}
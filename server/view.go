@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jeffreylo/cronofy"
+	"github.com/pkg/errors"
+)
+
+const maxViewDays = 62
+
+const viewUsage = "Please run `/cronofy view [today|tomorrow|week|next week|YYYY-MM-DD [YYYY-MM-DD]] [--calendar <name>]`"
+
+type ViewQuery struct {
+	From     time.Time
+	To       time.Time
+	Calendar string
+}
+
+func parseViewQuery(args []string, now time.Time) (*ViewQuery, error) {
+	query := &ViewQuery{}
+
+	rangeArgs := args
+	for i, arg := range args {
+		if arg == "--calendar" {
+			query.Calendar = strings.Join(args[i+1:], " ")
+			if query.Calendar == "" {
+				return nil, errors.New(viewUsage)
+			}
+			rangeArgs = args[:i]
+			break
+		}
+	}
+
+	today := startOfDay(now)
+	switch strings.ToLower(strings.Join(rangeArgs, " ")) {
+	case "":
+		query.From = now
+		query.To = today.AddDate(0, 0, 7)
+	case "today":
+		query.From = today
+		query.To = today.AddDate(0, 0, 1)
+	case "tomorrow":
+		query.From = today.AddDate(0, 0, 1)
+		query.To = today.AddDate(0, 0, 2)
+	case "week", "this week":
+		query.From = today
+		query.To = startOfWeek(today).AddDate(0, 0, 7)
+	case "next week":
+		query.From = startOfWeek(today).AddDate(0, 0, 7)
+		query.To = query.From.AddDate(0, 0, 7)
+	default:
+		if len(rangeArgs) > 2 {
+			return nil, errors.New(viewUsage)
+		}
+
+		first, err := time.ParseInLocation(CRONOFY_DATE_FORMAT, rangeArgs[0], now.Location())
+		if err != nil {
+			return nil, errors.New(viewUsage)
+		}
+
+		last := first
+		if len(rangeArgs) == 2 {
+			last, err = time.ParseInLocation(CRONOFY_DATE_FORMAT, rangeArgs[1], now.Location())
+			if err != nil {
+				return nil, errors.New(viewUsage)
+			}
+		}
+
+		if last.Before(first) {
+			return nil, errors.New("The end date must not be before the start date")
+		}
+
+		query.From = first
+		query.To = last.AddDate(0, 0, 1)
+	}
+
+	if query.To.Sub(query.From) > maxViewDays*24*time.Hour {
+		return nil, fmt.Errorf("Please choose a range of at most %d days", maxViewDays)
+	}
+
+	return query, nil
+}
+
+func startOfWeek(day time.Time) time.Time {
+	offset := (int(day.Weekday()) + 6) % 7
+	return startOfDay(day).AddDate(0, 0, -offset)
+}
+
+func (res *UserEvents) filterCalendar(name string) bool {
+	calendars := []*cronofy.Calendar{}
+	ids := map[string]bool{}
+	for _, c := range res.Calendars {
+		if strings.EqualFold(c.CalendarName, name) {
+			calendars = append(calendars, c)
+			ids[c.CalendarID] = true
+		}
+	}
+
+	events := []*cronofy.Event{}
+	for _, evt := range res.Events {
+		if ids[evt.CalendarID] {
+			events = append(events, evt)
+		}
+	}
+
+	res.Calendars = calendars
+	res.Events = events
+	return len(calendars) > 0
+}
+
+func formatViewTitle(from, to time.Time) string {
+	last := to.Add(-time.Nanosecond)
+	if startOfDay(from).Equal(startOfDay(last)) {
+		return fmt.Sprintf("### Calendar Events for %s\n\n", from.Format(DEFAULT_DATE_FORMAT))
+	}
+
+	return fmt.Sprintf("### Calendar Events from %s to %s\n\n", from.Format(DEFAULT_DATE_FORMAT), last.Format(DEFAULT_DATE_FORMAT))
+}
+
+func splitMessage(text string, limit int) []string {
+	messages := []string{}
+	current := ""
+	for _, line := range strings.SplitAfter(text, "\n") {
+		for len([]rune(line)) > limit {
+			if current != "" {
+				messages = append(messages, current)
+				current = ""
+			}
+			runes := []rune(line)
+			messages = append(messages, string(runes[:limit]))
+			line = string(runes[limit:])
+		}
+
+		if len([]rune(current))+len([]rune(line)) > limit {
+			messages = append(messages, current)
+			current = ""
+		}
+		current += line
+	}
+
+	if current != "" {
+		messages = append(messages, current)
+	}
+
+	return messages
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseViewQuery(t *testing.T) {
+	// A Wednesday afternoon.
+	now := time.Date(2019, 11, 27, 15, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time {
+		return time.Date(2019, 11, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	for name, tc := range map[string]struct {
+		args     []string
+		from, to time.Time
+		calendar string
+	}{
+		"default":       {nil, now, day(27).AddDate(0, 0, 7), ""},
+		"today":         {[]string{"today"}, day(27), day(28), ""},
+		"tomorrow":      {[]string{"tomorrow"}, day(28), day(29), ""},
+		"week":          {[]string{"week"}, day(27), time.Date(2019, 12, 2, 0, 0, 0, 0, time.UTC), ""},
+		"next week":     {[]string{"next", "week"}, time.Date(2019, 12, 2, 0, 0, 0, 0, time.UTC), time.Date(2019, 12, 9, 0, 0, 0, 0, time.UTC), ""},
+		"one date":      {[]string{"2019-11-25"}, day(25), day(26), ""},
+		"date range":    {[]string{"2019-11-25", "2019-11-26"}, day(25), day(27), ""},
+		"with calendar": {[]string{"today", "--calendar", "Team", "Events"}, day(27), day(28), "Team Events"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			query, err := parseViewQuery(tc.args, now)
+			require.Nil(t, err)
+			assert.Equal(t, tc.from, query.From)
+			assert.Equal(t, tc.to, query.To)
+			assert.Equal(t, tc.calendar, query.Calendar)
+		})
+	}
+
+	for _, args := range [][]string{{"yesterday"}, {"2019-11-26", "2019-11-25"}, {"2019-01-01", "2019-12-31"}, {"--calendar"}} {
+		_, err := parseViewQuery(args, now)
+		assert.NotNil(t, err, args)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	text := strings.Repeat("line one\n", 10)
+
+	messages := splitMessage(text, 20)
+	require.Len(t, messages, 5)
+	assert.Equal(t, "line one\nline one\n", messages[0])
+	assert.Equal(t, text, strings.Join(messages, ""))
+
+	assert.Equal(t, []string{"abcde", "fgh"}, splitMessage("abcdefgh", 5))
+}